@@ -0,0 +1,187 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"time"
+)
+
+// maxBulkURLs caps how many entries a single bulk submission may hold
+const maxBulkURLs = 10000
+
+// bulkSubmitTimeout bounds how long a bulk submission spends queuing its
+// entries, the ones left when it runs out are rejected
+const bulkSubmitTimeout = time.Minute
+
+type BulkSubmitResult struct {
+	Index  int    `json:"index"`
+	URL    string `json:"url,omitempty"`
+	Status string `json:"status"`
+	JobID  string `json:"job_id,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// BulkSubmitResponse reports the outcome of every entry read. If the body
+// could not be read to the end, Error says why and the entries after the
+// last result were not submitted.
+type BulkSubmitResponse struct {
+	Accepted int                `json:"accepted"`
+	Rejected int                `json:"rejected"`
+	Results  []BulkSubmitResult `json:"results"`
+	Error    string             `json:"error,omitempty"`
+}
+
+func (r *BulkSubmitResponse) accept(index int, url, jobID string) {
+	r.Accepted++
+	r.Results = append(r.Results, BulkSubmitResult{Index: index, URL: url, Status: "accepted", JobID: jobID})
+}
+
+func (r *BulkSubmitResponse) reject(index int, url, reason string) {
+	r.Rejected++
+	r.Results = append(r.Results, BulkSubmitResult{Index: index, URL: url, Status: "rejected", Reason: reason})
+}
+
+// SubmitURLs accepts many URLs at once, either as a JSON array of
+// SubmitURLRequest objects or, with an application/x-ndjson content type, as
+// one object per line. Every entry is validated and queued on its own and the
+// response reports whether each one was accepted. Queuing waits while the
+// download queue is full, throttling a large submission to the speed of the
+// downloads, but once an entry can't be queued in time it and every entry
+// after it are rejected, as are those left when bulkSubmitTimeout runs out.
+func (h *Handler) SubmitURLs(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), bulkSubmitTimeout)
+	defer cancel()
+
+	response := BulkSubmitResponse{Results: make([]BulkSubmitResult, 0)}
+	full := false
+	submit := func(index int, raw []byte) {
+		var req SubmitURLRequest
+		if err := json.Unmarshal(raw, &req); err != nil {
+			response.reject(index, "", fmt.Sprintf("decoding entry: %s", err))
+			return
+		}
+		if err := req.isValidURL(); err != nil {
+			response.reject(index, req.URL, err.Error())
+			return
+		}
+		canonicalURL, err := h.canonical(req.URL)
+		if err != nil {
+			response.reject(index, req.URL, err.Error())
+			return
+		}
+		if err := h.tasks.Check(ctx, canonicalURL); err != nil {
+			response.reject(index, req.URL, err.Error())
+			return
+		}
+		// Once the queue has stalled, waiting on it again for every entry
+		// left would hold the request for hours
+		if full {
+			response.reject(index, req.URL, "download queue is full")
+			return
+		}
+
+		enqueueCtx, cancelEnqueue := context.WithTimeout(ctx, enqueueTimeout)
+		defer cancelEnqueue()
+		job, err := h.tasks.Submit(enqueueCtx, canonicalURL, req.URL)
+		if err != nil {
+			full = true
+			response.reject(index, req.URL, "download queue is full")
+			return
+		}
+		response.accept(index, req.URL, job.ID)
+	}
+
+	var err error
+	if isNDJSON(r.Header.Get("Content-Type")) {
+		err = readNDJSON(r.Body, submit)
+	} else {
+		err = readJSONArray(r.Body, submit)
+	}
+	if err != nil {
+		// Nothing was read so the whole submission can be rejected,
+		// otherwise report how far it got
+		if len(response.Results) == 0 {
+			http.Error(w, fmt.Sprintf("error: decoding bulk submission: %s", err), http.StatusBadRequest)
+			return
+		}
+		response.Error = fmt.Sprintf("decoding bulk submission: %s", err)
+	}
+
+	err = json.NewEncoder(w).Encode(response)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error: encoding bulk submission results: %s", err), http.StatusInternalServerError)
+	}
+
+}
+
+func isNDJSON(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	switch mediaType {
+	case "application/x-ndjson", "application/ndjson", "application/jsonl", "application/x-jsonlines":
+		return true
+	}
+	return false
+}
+
+// readNDJSON calls submit for every non-empty line. A malformed line only
+// rejects that entry as the next line can still be read.
+func readNDJSON(body io.Reader, submit func(int, []byte)) error {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	index := 0
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		if index == maxBulkURLs {
+			return fmt.Errorf("more than %d entries, the rest were ignored", maxBulkURLs)
+		}
+		submit(index, line)
+		index++
+	}
+	return scanner.Err()
+}
+
+// readJSONArray streams the elements of a JSON array to submit without
+// holding the whole array in memory
+func readJSONArray(body io.Reader, submit func(int, []byte)) error {
+	decoder := json.NewDecoder(body)
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != '[' {
+		return errors.New("expected a JSON array")
+	}
+
+	for index := 0; decoder.More(); index++ {
+		if index == maxBulkURLs {
+			return fmt.Errorf("more than %d entries, the rest were ignored", maxBulkURLs)
+		}
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err != nil {
+			return err
+		}
+		submit(index, raw)
+	}
+
+	_, err = decoder.Token()
+	return err
+}
@@ -1,26 +1,109 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
+	"slices"
+	"spamhaus/archive"
+	"spamhaus/canonical"
 	"spamhaus/downloader"
 	"spamhaus/store"
 	"strconv"
+	"strings"
+	"time"
 )
 
+// TaskQueue accepts urls to be downloaded and reports on their progress, it
+// is implemented by downloader.WorkerPool. Check says why a url would be
+// refused, before it is submitted. Submit takes the canonical url along with
+// the form it was submitted in.
+type TaskQueue interface {
+	Check(ctx context.Context, url string) error
+	Submit(ctx context.Context, url, submitted string) (downloader.Job, error)
+	Job(id string) (downloader.Job, bool)
+}
+
+// enqueueTimeout is how long a submission waits for room in the download
+// queue before it is rejected
+const enqueueTimeout = 10 * time.Second
+
+// Handler serves the API against the given store and download queue.
+// archive is nil when bodies aren't archived and canon is nil when URLs are
+// stored as they are submitted.
+type Handler struct {
+	store   store.Store
+	tasks   TaskQueue
+	archive *archive.Archive
+	canon   *canonical.Canonicalizer
+}
+
+func NewHandler(s store.Store, tasks TaskQueue, blobs *archive.Archive, canon *canonical.Canonicalizer) *Handler {
+	return &Handler{
+		store:   s,
+		tasks:   tasks,
+		archive: blobs,
+		canon:   canon,
+	}
+}
+
+// lookup finds a URL by its ID, the URL it is stored under or any other way
+// of writing that URL
+func (h *Handler) lookup(key string) (*store.URLNode, bool) {
+	if node, ok := h.store.Get(key); ok {
+		return node, true
+	}
+	canonicalURL, err := h.canonical(key)
+	if err != nil || canonicalURL == key {
+		return nil, false
+	}
+	return h.store.Get(canonicalURL)
+}
+
+// canonical returns the form a submitted URL is stored under
+func (h *Handler) canonical(rawURL string) (string, error) {
+	if h.canon == nil {
+		return rawURL, nil
+	}
+	return h.canon.URL(rawURL)
+}
+
 type SubmitURLRequest struct {
 	URL string `json:"url"`
 }
 
 type TopURLSResponse struct {
-	URL   string `json:"url"`
-	Count int    `json:"count"`
+	ID             string              `json:"id"`
+	URL            string              `json:"url"`
+	Count          int                 `json:"count"`
+	Fetches        int                 `json:"fetches"`
+	Successes      int                 `json:"successes"`
+	Failures       int                 `json:"failures"`
+	Blocked        int                 `json:"blocked"`
+	NotModified    int                 `json:"not_modified"`
+	Aborted        int                 `json:"aborted"`
+	SuccessRate    float64             `json:"success_rate"`
+	LastDownloadMs int64               `json:"last_download_ms"`
+	LastSubmitted  time.Time           `json:"last_submitted"`
+	LastFetched    *time.Time          `json:"last_fetched,omitempty"`
+	LastStatusCode int                 `json:"last_status_code,omitempty"`
+	ContentType    string              `json:"content_type,omitempty"`
+	ChangeCount    int                 `json:"change_count"`
+	LastChanged    *time.Time          `json:"last_changed,omitempty"`
+	Latency        *store.LatencyStats `json:"latency,omitempty"`
+	// WindowCount is the submissions over the listing's window, if it has
+	// one
+	WindowCount *int `json:"window_count,omitempty"`
+
+	Redirected           int `json:"redirected"`
+	CrossDomainRedirects int `json:"cross_domain_redirects"`
+	DowngradeRedirects   int `json:"downgrade_redirects"`
 }
 
-func SubmitURL(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) SubmitURL(w http.ResponseWriter, r *http.Request) {
 
 	if r.Method != "POST" {
 		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
@@ -42,11 +125,26 @@ func SubmitURL(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprintf("error: validating url from SubmitURLRequest: %s", err), http.StatusBadRequest)
 		return
 	}
+	canonicalURL, err := h.canonical(req.URL)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error: validating url from SubmitURLRequest: %s", err), http.StatusBadRequest)
+		return
+	}
+	if err := h.tasks.Check(r.Context(), canonicalURL); err != nil {
+		http.Error(w, fmt.Sprintf("error: url not allowed: %s", err), http.StatusForbidden)
+		return
+	}
 
 	// Add download job for this URL to the worker pool
-	go downloader.AddTask(req.URL)
+	ctx, cancel := context.WithTimeout(r.Context(), enqueueTimeout)
+	defer cancel()
+	job, err := h.tasks.Submit(ctx, canonicalURL, req.URL)
+	if err != nil {
+		http.Error(w, "error: download queue is full", http.StatusServiceUnavailable)
+		return
+	}
 
-	err = json.NewEncoder(w).Encode(map[string]string{"message": "url submitted"})
+	err = json.NewEncoder(w).Encode(map[string]string{"message": "url submitted", "job_id": job.ID, "url": canonicalURL})
 	if err != nil {
 		http.Error(w, fmt.Sprintf("error: encoding url to SubmitURLRequest: %s", err), http.StatusInternalServerError)
 		return
@@ -54,7 +152,7 @@ func SubmitURL(w http.ResponseWriter, r *http.Request) {
 
 }
 
-func TopURLs(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) TopURLs(w http.ResponseWriter, r *http.Request) {
 
 	if r.Method != "GET" {
 		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
@@ -62,28 +160,68 @@ func TopURLs(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Fetch and validate query params
-	sortBy := r.URL.Query().Get("sort_by")
-	getTopN := r.URL.Query().Get("get_n")
-	if sortBy != "count" && sortBy != "latest" {
-		http.Error(w, fmt.Sprintf("error: invalid sort by %s", sortBy), http.StatusBadRequest)
+	query, err := parseListQuery(r.URL.Query(), h.store.Windows())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error: %s", err), http.StatusBadRequest)
+		return
 	}
 
-	n, err := strconv.Atoi(getTopN)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("error: invalid n: %s should be convertable to int", getTopN), http.StatusBadRequest)
+	// Fetch one more than asked for to know whether there is another page.
+	// Windowed counts are taken as of now for the cursor too.
+	limit := query.Limit
+	query.Limit++
+	query.At = time.Now()
+	urls := h.store.Filter(query)
+
+	page := TopURLsPage{URLs: make([]TopURLSResponse, 0, limit)}
+	if len(urls) > limit {
+		urls = urls[:limit]
+		if limit > 0 {
+			page.NextCursor = store.CursorAfter(query, urls[limit-1]).Encode()
+		}
 	}
 
-	// Filter for the latest n URLs
-	urls := store.Filter(n, sortBy)
-	responses := make([]TopURLSResponse, 0, n)
 	for _, node := range urls {
-		responses = append(responses, TopURLSResponse{
-			URL:   node.URL,
-			Count: node.Data.Count,
-		})
+		data := node.Data
+		latency := data.History.Stats()
+		result := TopURLSResponse{
+			ID:             node.ID,
+			URL:            node.URL,
+			Count:          data.Count,
+			Fetches:        data.Fetches,
+			Successes:      data.Successes,
+			Failures:       data.Failures,
+			Blocked:        data.Blocked,
+			NotModified:    data.NotModified,
+			Aborted:        data.Aborted,
+			SuccessRate:    data.SuccessRate(),
+			LastDownloadMs: data.LastDownloadMs,
+			LastSubmitted:  data.LastSubmitted,
+			ChangeCount:    data.ChangeCount,
+			Latency:        &latency,
+
+			Redirected:           data.Redirected,
+			CrossDomainRedirects: data.CrossDomainRedirects,
+			DowngradeRedirects:   data.DowngradeRedirects,
+		}
+		if query.Window != 0 {
+			windowCount := data.RecentCount(query.Window, query.At)
+			result.WindowCount = &windowCount
+		}
+		if last := data.LastResponse; last != nil {
+			result.LastStatusCode = last.StatusCode
+			result.ContentType = last.ContentType
+		}
+		if !data.LastChanged.IsZero() {
+			result.LastChanged = &data.LastChanged
+		}
+		if !data.LastFetched.IsZero() {
+			result.LastFetched = &data.LastFetched
+		}
+		page.URLs = append(page.URLs, result)
 	}
 
-	jsonData, err := json.Marshal(responses)
+	jsonData, err := json.Marshal(page)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("error: encoding top urls: %s", err), http.StatusInternalServerError)
 		return
@@ -97,6 +235,233 @@ func TopURLs(w http.ResponseWriter, r *http.Request) {
 
 }
 
+// TopURLsPage is one page of a URL listing. NextCursor is only set when there
+// are more URLs, pass it back as the cursor parameter to fetch them.
+type TopURLsPage struct {
+	URLs       []TopURLSResponse `json:"urls"`
+	NextCursor string            `json:"next_cursor,omitempty"`
+}
+
+// parseListQuery builds a store query from the listing query parameters.
+// sort_by and the page size, limit or its older name get_n, are required,
+// every filter is optional. window has to be one of the store's windows.
+func parseListQuery(params url.Values, windows []time.Duration) (store.Query, error) {
+	sortBy := params.Get("sort_by")
+	if !store.ValidSort(sortBy) {
+		return store.Query{}, fmt.Errorf("invalid sort by %s", sortBy)
+	}
+
+	getTopN := params.Get("limit")
+	if getTopN == "" {
+		getTopN = params.Get("get_n")
+	}
+	n, err := strconv.Atoi(getTopN)
+	if err != nil || n < 0 {
+		return store.Query{}, fmt.Errorf("invalid n: %s should be convertable to a positive int", getTopN)
+	}
+
+	query := store.Query{
+		Limit:  n,
+		SortBy: sortBy,
+		Host:   params.Get("host"),
+	}
+
+	switch order := params.Get("order"); order {
+	case "", "desc":
+	case "asc":
+		query.Ascending = true
+	default:
+		return store.Query{}, fmt.Errorf("invalid order %s should be asc or desc", order)
+	}
+
+	if minCount := params.Get("min_count"); minCount != "" {
+		query.MinCount, err = strconv.Atoi(minCount)
+		if err != nil {
+			return store.Query{}, fmt.Errorf("invalid min_count: %s should be convertable to int", minCount)
+		}
+	}
+
+	if failing := params.Get("failing"); failing != "" {
+		query.FailingOnly, err = strconv.ParseBool(failing)
+		if err != nil {
+			return store.Query{}, fmt.Errorf("invalid failing: %s should be true or false", failing)
+		}
+	}
+
+	if query.Since, err = parseTime(params, "since"); err != nil {
+		return store.Query{}, err
+	}
+	if query.Until, err = parseTime(params, "until"); err != nil {
+		return store.Query{}, err
+	}
+	if query.ChangedSince, err = parseTime(params, "changed_since"); err != nil {
+		return store.Query{}, err
+	}
+
+	query.Redirect = params.Get("redirect")
+	if !store.ValidRedirect(query.Redirect) {
+		return store.Query{}, fmt.Errorf("invalid redirect %s should be any, cross_domain or downgrade", query.Redirect)
+	}
+
+	if window := params.Get("window"); window != "" {
+		d, err := time.ParseDuration(window)
+		if err != nil || !slices.Contains(windows, d) {
+			return store.Query{}, fmt.Errorf("invalid window %s should be one of %s", window, windowNames(windows))
+		}
+		query.Window = d
+	}
+
+	if cursor := params.Get("cursor"); cursor != "" {
+		query.After, err = store.DecodeCursor(cursor, query)
+		if err != nil {
+			return store.Query{}, err
+		}
+	}
+
+	return query, nil
+}
+
+// windowNames lists the windows as they are given to the API
+func windowNames(windows []time.Duration) string {
+	names := make([]string, 0, len(windows))
+	for _, window := range windows {
+		names = append(names, store.WindowName(window))
+	}
+	return strings.Join(names, ", ")
+}
+
+// parseTime reads an optional RFC 3339 timestamp query parameter
+func parseTime(params url.Values, name string) (time.Time, error) {
+	value := params.Get(name)
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %s: %s should be an RFC 3339 timestamp", name, value)
+	}
+	return t, nil
+}
+
+// URLDetailResponse is the complete record the store holds for a single URL
+type URLDetailResponse struct {
+	ID             string             `json:"id"`
+	URL            string             `json:"url"`
+	SubmittedAs    []string           `json:"submitted_as,omitempty"`
+	Count          int                `json:"count"`
+	Fetches        int                `json:"fetches"`
+	Successes      int                `json:"successes"`
+	Failures       int                `json:"failures"`
+	Blocked        int                `json:"blocked"`
+	NotModified    int                `json:"not_modified"`
+	Aborted        int                `json:"aborted"`
+	LastDownloadMs int64              `json:"last_download_ms"`
+	LastSubmitted  time.Time          `json:"last_submitted"`
+	LastFetched    *time.Time         `json:"last_fetched,omitempty"`
+	Recent         map[string]int     `json:"recent"`
+	LastAttempt    *store.Attempt     `json:"last_attempt,omitempty"`
+	LastResponse   *store.Attempt     `json:"last_response,omitempty"`
+	ChangeCount    int                `json:"change_count"`
+	LastChanged    *time.Time         `json:"last_changed,omitempty"`
+	Changes        []store.Change     `json:"changes"`
+	Latency        store.LatencyStats `json:"latency"`
+	History        []store.Attempt    `json:"history"`
+
+	Redirected           int `json:"redirected"`
+	CrossDomainRedirects int `json:"cross_domain_redirects"`
+	DowngradeRedirects   int `json:"downgrade_redirects"`
+}
+
+// URLDetail returns everything the store knows about one URL. The URL is
+// given either by its ID or as a path escaped URL, e.g.
+// /urls/http%3A%2F%2Fexample.com
+func (h *Handler) URLDetail(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "GET" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	key := r.PathValue("id")
+	node, ok := h.lookup(key)
+	if !ok {
+		http.Error(w, fmt.Sprintf("error: url %s not found", key), http.StatusNotFound)
+		return
+	}
+
+	data := node.Data
+	history := data.History.Attempts()
+	response := URLDetailResponse{
+		ID:             node.ID,
+		URL:            node.URL,
+		SubmittedAs:    data.SubmittedAs,
+		Count:          data.Count,
+		Fetches:        data.Fetches,
+		Successes:      data.Successes,
+		Failures:       data.Failures,
+		Blocked:        data.Blocked,
+		NotModified:    data.NotModified,
+		Aborted:        data.Aborted,
+		LastDownloadMs: data.LastDownloadMs,
+		LastSubmitted:  data.LastSubmitted,
+		LastResponse:   data.LastResponse,
+		ChangeCount:    data.ChangeCount,
+		Changes:        data.Changes,
+		Latency:        data.History.Stats(),
+		History:        history,
+
+		Redirected:           data.Redirected,
+		CrossDomainRedirects: data.CrossDomainRedirects,
+		DowngradeRedirects:   data.DowngradeRedirects,
+	}
+	if len(history) > 0 {
+		response.LastAttempt = &history[len(history)-1]
+	}
+	if response.Changes == nil {
+		response.Changes = []store.Change{}
+	}
+	if !data.LastChanged.IsZero() {
+		response.LastChanged = &data.LastChanged
+	}
+	if !data.LastFetched.IsZero() {
+		response.LastFetched = &data.LastFetched
+	}
+	now := time.Now()
+	response.Recent = make(map[string]int)
+	for _, window := range h.store.Windows() {
+		response.Recent[store.WindowName(window)] = data.RecentCount(window, now)
+	}
+
+	err := json.NewEncoder(w).Encode(response)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error: encoding url detail: %s", err), http.StatusInternalServerError)
+	}
+
+}
+
+// JobStatus reports the progress of the download started by a submission
+func (h *Handler) JobStatus(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "GET" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := r.PathValue("id")
+	job, ok := h.tasks.Job(id)
+	if !ok {
+		http.Error(w, fmt.Sprintf("error: job %s not found", id), http.StatusNotFound)
+		return
+	}
+
+	err := json.NewEncoder(w).Encode(job)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error: encoding job: %s", err), http.StatusInternalServerError)
+	}
+
+}
+
 // validateURL checks if a given URL is valid.
 func (u *SubmitURLRequest) isValidURL() error {
 	parsedURL, err := url.ParseRequestURI(u.URL)
@@ -2,26 +2,77 @@ package api
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"spamhaus/archive"
+	"spamhaus/canonical"
+	"spamhaus/downloader"
 	"spamhaus/store"
+	"strings"
 	"testing"
 )
 
-// Mock the store.Filter function to return dummy data for testing
-func newStore() {
-	store.New()
+// fakeQueue records submitted urls instead of downloading them. tries
+// counts the calls to Submit, queued or not.
+type fakeQueue struct {
+	urls      chan string
+	submitted map[string]string
+	jobs      map[string]downloader.Job
+	tries     int
+}
+
+func newFakeQueue(size int) *fakeQueue {
+	return &fakeQueue{urls: make(chan string, size), submitted: make(map[string]string), jobs: make(map[string]downloader.Job)}
+}
+
+func (q *fakeQueue) Submit(ctx context.Context, url, submitted string) (downloader.Job, error) {
+	q.tries++
+	select {
+	case q.urls <- url:
+		q.submitted[url] = submitted
+		job := downloader.Job{ID: fmt.Sprintf("job%d", len(q.jobs)), URL: url, Status: downloader.JobQueued}
+		q.jobs[job.ID] = job
+		return job, nil
+	default:
+		return downloader.Job{}, errors.New("queue full")
+	}
+}
+
+// Check refuses localhost like the ssrf guard would
+func (q *fakeQueue) Check(ctx context.Context, rawURL string) error {
+	if u, err := url.Parse(rawURL); err == nil && u.Hostname() == "localhost" {
+		return errors.New("forbidden by ssrf guard")
+	}
+	return nil
+}
+
+func (q *fakeQueue) Job(id string) (downloader.Job, bool) {
+	job, ok := q.jobs[id]
+	return job, ok
+}
+
+// Populate an in memory store with dummy data for testing
+func newStore() *store.URLStore {
+	s := store.NewMemoryStore(store.Config{})
 	for i := 0; i < 2; i++ {
-		store.Update(
+		s.Update(
 			fmt.Sprintf("http://example%d.com", i),
-			true,
-			int64(100+i),
+			store.Attempt{Success: true, DurationMs: int64(100 + i)},
 		)
 	}
+	return s
 }
 func TestSubmitURL(t *testing.T) {
+	queue := newFakeQueue(10)
+	h := NewHandler(newStore(), queue, nil, nil)
 
 	tests := []struct {
 		name            string
@@ -39,6 +90,11 @@ func TestSubmitURL(t *testing.T) {
 			body:           `{"url": "invalid-url"}`,
 			expectedStatus: http.StatusBadRequest,
 		},
+		{
+			name:           "URL refused by the ssrf guard",
+			body:           `{"url": "http://localhost/admin"}`,
+			expectedStatus: http.StatusForbidden,
+		},
 	}
 
 	for _, tt := range tests {
@@ -53,7 +109,7 @@ func TestSubmitURL(t *testing.T) {
 			rr := httptest.NewRecorder()
 
 			// Call the SubmitURL handler
-			handler := http.HandlerFunc(SubmitURL)
+			handler := http.HandlerFunc(h.SubmitURL)
 			handler.ServeHTTP(rr, req)
 
 			// Check the status code
@@ -61,21 +117,77 @@ func TestSubmitURL(t *testing.T) {
 				t.Errorf("expected status %v, got %v", tt.expectedStatus, rr.Code)
 			}
 
+			// Accepted submissions can be polled by their job id
+			if rr.Code == http.StatusOK {
+				var res map[string]string
+				if err := json.Unmarshal(rr.Body.Bytes(), &res); err != nil {
+					t.Fatalf("could not unmarshal response: %v", err)
+				}
+				if _, ok := queue.jobs[res["job_id"]]; !ok {
+					t.Errorf("expected a job id for a queued job, got %q", res["job_id"])
+				}
+			}
+
+		})
+	}
+}
+
+func TestJobStatus(t *testing.T) {
+	queue := newFakeQueue(10)
+	job, _ := queue.Submit(context.Background(), "http://example0.com", "")
+	router := NewRouter(NewHandler(newStore(), queue, nil, nil))
+
+	tests := []struct {
+		name           string
+		id             string
+		expectedStatus int
+	}{
+		{name: "known job", id: job.ID, expectedStatus: http.StatusOK},
+		{name: "unknown job", id: "missing", expectedStatus: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/jobs/"+tt.id, nil))
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %v, got %v", tt.expectedStatus, rr.Code)
+			}
+			if rr.Code != http.StatusOK {
+				return
+			}
+
+			var res downloader.Job
+			if err := json.Unmarshal(rr.Body.Bytes(), &res); err != nil {
+				t.Fatalf("could not unmarshal response: %v", err)
+			}
+			if res.ID != job.ID || res.Status != downloader.JobQueued {
+				t.Errorf("expected job %s to be queued, got %+v", job.ID, res)
+			}
 		})
 	}
 }
 
 func TestTopURLs(t *testing.T) {
 	// Prepare the test data
-	newStore()
+	s := newStore()
+	h := NewHandler(s, newFakeQueue(10), nil, nil)
 
 	// Give example0 3 count
-	store.Update("http://example0.com", true, 100)
-	store.Update("http://example0.com", true, 100)
+	s.Update("http://example0.com", store.Attempt{Success: true, DurationMs: 100})
+	s.Update("http://example0.com", store.Attempt{Success: true, DurationMs: 100})
 
 	// Then example1 = 2, example2 = 1
-	store.Update("http://example2.com", true, 200)
-	store.Update("http://example1.com", true, 150)
+	s.Update("http://example2.com", store.Attempt{Success: true, DurationMs: 200, Redirects: []store.Redirect{
+		{URL: "http://example2.com", StatusCode: 302, Location: "http://elsewhere.net", CrossDomain: true},
+	}})
+	s.Update("http://example1.com", store.Attempt{Success: true, DurationMs: 150})
+
+	// Refetches of example2 neither count as submissions nor make it the latest
+	for i := 0; i < 3; i++ {
+		s.Update("http://example2.com", store.Attempt{Success: true, DurationMs: 200, Refetch: true})
+	}
 
 	tests := []struct {
 		name             string
@@ -106,6 +218,34 @@ func TestTopURLs(t *testing.T) {
 				{URL: "http://example0.com", Count: 3},
 			},
 		},
+		{
+			name:           "valid request for top URLs sorted by fetches",
+			sortBy:         "fetches",
+			getTopN:        "3",
+			expectedStatus: http.StatusOK,
+			expectedResponse: []TopURLSResponse{
+				{URL: "http://example2.com", Count: 1},
+				{URL: "http://example0.com", Count: 3},
+				{URL: "http://example1.com", Count: 2},
+			},
+		},
+		{
+			name:           "valid request for top URLs sorted by count over a window",
+			sortBy:         "count",
+			getTopN:        "3&window=5m",
+			expectedStatus: http.StatusOK,
+			expectedResponse: []TopURLSResponse{
+				{URL: "http://example0.com", Count: 3, WindowCount: intPtr(3)},
+				{URL: "http://example1.com", Count: 2, WindowCount: intPtr(2)},
+				{URL: "http://example2.com", Count: 1, WindowCount: intPtr(1)},
+			},
+		},
+		{
+			name:           "window the store doesn't count over",
+			sortBy:         "count",
+			getTopN:        "3&window=2m",
+			expectedStatus: http.StatusBadRequest,
+		},
 		{
 			name:           "invalid sort by parameter",
 			sortBy:         "invalid",
@@ -118,6 +258,42 @@ func TestTopURLs(t *testing.T) {
 			getTopN:        "not-a-number",
 			expectedStatus: http.StatusBadRequest,
 		},
+		{
+			name:           "valid request for failing URLs on a host",
+			sortBy:         "failures",
+			getTopN:        "3&host=example0.com&min_count=2",
+			expectedStatus: http.StatusOK,
+			expectedResponse: []TopURLSResponse{
+				{URL: "http://example0.com", Count: 3},
+			},
+		},
+		{
+			name:           "invalid order parameter",
+			sortBy:         "count",
+			getTopN:        "3&order=sideways",
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "valid request for cross domain redirects",
+			sortBy:         "count",
+			getTopN:        "3&redirect=cross_domain",
+			expectedStatus: http.StatusOK,
+			expectedResponse: []TopURLSResponse{
+				{URL: "http://example2.com", Count: 1},
+			},
+		},
+		{
+			name:           "invalid redirect parameter",
+			sortBy:         "count",
+			getTopN:        "3&redirect=sideways",
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "invalid since parameter",
+			sortBy:         "count",
+			getTopN:        "3&since=yesterday",
+			expectedStatus: http.StatusBadRequest,
+		},
 		{
 			name:           "empty getTopN value",
 			sortBy:         "count",
@@ -139,7 +315,7 @@ func TestTopURLs(t *testing.T) {
 			rr := httptest.NewRecorder()
 
 			// Call the TopURLs handler
-			handler := http.HandlerFunc(TopURLs)
+			handler := http.HandlerFunc(h.TopURLs)
 			handler.ServeHTTP(rr, req)
 
 			// Check the status code
@@ -149,11 +325,12 @@ func TestTopURLs(t *testing.T) {
 
 			// Check the response body for valid results
 			if rr.Code == http.StatusOK {
-				var res []TopURLSResponse
-				err := json.Unmarshal(rr.Body.Bytes(), &res)
+				var page TopURLsPage
+				err := json.Unmarshal(rr.Body.Bytes(), &page)
 				if err != nil {
 					t.Fatalf("could not unmarshal response: %v", err)
 				}
+				res := page.URLs
 
 				if len(res) != len(tt.expectedResponse) {
 					t.Fatalf("expected response length %d, got %d", len(tt.expectedResponse), len(res))
@@ -161,7 +338,8 @@ func TestTopURLs(t *testing.T) {
 
 				// Check each returned URL in response
 				for i, item := range res {
-					if item.URL != tt.expectedResponse[i].URL || item.Count != tt.expectedResponse[i].Count {
+					expected := tt.expectedResponse[i]
+					if item.URL != expected.URL || item.Count != expected.Count || fmt.Sprint(derefInt(item.WindowCount)) != fmt.Sprint(derefInt(expected.WindowCount)) {
 						t.Errorf("expected %v, got %v", tt.expectedResponse[i], item)
 					}
 				}
@@ -169,3 +347,397 @@ func TestTopURLs(t *testing.T) {
 		})
 	}
 }
+
+// intPtr returns a pointer to n, for setting optional ints in expectations
+func intPtr(n int) *int {
+	return &n
+}
+
+// derefInt returns the value of an optional int, nil if it is unset
+func derefInt(p *int) any {
+	if p == nil {
+		return nil
+	}
+	return *p
+}
+
+// TestTopURLsPagination pages through the store while urls are being
+// resubmitted and checks that every url is returned exactly once
+func TestTopURLsPagination(t *testing.T) {
+	s := store.NewMemoryStore(store.Config{})
+	for i := 0; i < 7; i++ {
+		s.Update(fmt.Sprintf("http://example%d.com", i), store.Attempt{Success: true})
+	}
+	h := NewHandler(s, newFakeQueue(10), nil, nil)
+
+	fetch := func(cursor string) TopURLsPage {
+		req := httptest.NewRequest(http.MethodGet, "/topurls?sort_by=latest&limit=3&cursor="+cursor, nil)
+		rr := httptest.NewRecorder()
+		h.TopURLs(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status %v, got %v: %s", http.StatusOK, rr.Code, rr.Body.String())
+		}
+
+		var page TopURLsPage
+		if err := json.Unmarshal(rr.Body.Bytes(), &page); err != nil {
+			t.Fatalf("could not unmarshal response: %v", err)
+		}
+		return page
+	}
+
+	seen := make(map[string]int)
+	page := fetch("")
+	for pages := 1; ; pages++ {
+		for _, item := range page.URLs {
+			seen[item.URL]++
+		}
+
+		// Resubmissions move urls to the tail of the list between pages
+		s.Update(page.URLs[0].URL, store.Attempt{Success: true})
+		s.Update("http://example0.com", store.Attempt{Success: true})
+
+		if page.NextCursor == "" {
+			if pages != 2 {
+				t.Errorf("expected 2 pages, got %d", pages)
+			}
+			break
+		}
+		page = fetch(page.NextCursor)
+	}
+
+	// example0 was resubmitted before the listing reached it, so it moved
+	// ahead of the cursor instead of being listed twice
+	for i := 1; i < 7; i++ {
+		url := fmt.Sprintf("http://example%d.com", i)
+		if seen[url] != 1 {
+			t.Errorf("expected %s to be listed once, got %d", url, seen[url])
+		}
+	}
+	if seen["http://example0.com"] != 0 {
+		t.Errorf("expected http://example0.com to have moved ahead of the cursor")
+	}
+
+	// A cursor can't be reused with a different sort order
+	req := httptest.NewRequest(http.MethodGet, "/topurls?sort_by=count&limit=3&cursor="+fetch("").NextCursor, nil)
+	rr := httptest.NewRecorder()
+	h.TopURLs(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected status %v for a mismatched cursor, got %v", http.StatusBadRequest, rr.Code)
+	}
+}
+
+func TestURLDetail(t *testing.T) {
+	s := newStore()
+	s.Update("http://example0.com", store.Attempt{Success: false, StatusCode: 500, Error: "server error"})
+	router := NewRouter(NewHandler(s, newFakeQueue(10), nil, nil))
+
+	tests := []struct {
+		name           string
+		path           string
+		expectedStatus int
+		expectedCount  int
+	}{
+		{
+			name:           "lookup by id",
+			path:           "/urls/" + store.URLID("http://example0.com"),
+			expectedStatus: http.StatusOK,
+			expectedCount:  2,
+		},
+		{
+			name:           "lookup by escaped url",
+			path:           "/urls/" + url.PathEscape("http://example0.com"),
+			expectedStatus: http.StatusOK,
+			expectedCount:  2,
+		},
+		{
+			name:           "unknown url",
+			path:           "/urls/" + url.PathEscape("http://unknown.com"),
+			expectedStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %v, got %v", tt.expectedStatus, rr.Code)
+			}
+			if rr.Code != http.StatusOK {
+				return
+			}
+
+			var res URLDetailResponse
+			if err := json.Unmarshal(rr.Body.Bytes(), &res); err != nil {
+				t.Fatalf("could not unmarshal response: %v", err)
+			}
+			if res.URL != "http://example0.com" || res.Count != tt.expectedCount || res.Failures != 1 || len(res.History) != 2 {
+				t.Errorf("unexpected url detail %+v", res)
+			}
+			if res.LastAttempt == nil || res.LastAttempt.StatusCode != 500 {
+				t.Errorf("expected last attempt to have failed with a 500, got %+v", res.LastAttempt)
+			}
+		})
+	}
+}
+
+func TestSubmitURLs(t *testing.T) {
+	tests := []struct {
+		name             string
+		contentType      string
+		body             string
+		queueSize        int
+		expectedStatus   int
+		expectedStatuses []string
+		expectedQueued   int
+		expectedTries    int
+	}{
+		{
+			name:             "json array with invalid and refused entries",
+			contentType:      "application/json",
+			body:             `[{"url": "http://a.com"}, {"url": "not-a-url"}, {"url": "https://b.com/path"}, {"url": "http://localhost:8080"}]`,
+			queueSize:        10,
+			expectedStatus:   http.StatusOK,
+			expectedStatuses: []string{"accepted", "rejected", "accepted", "rejected"},
+			expectedQueued:   2,
+		},
+		{
+			name:             "ndjson with a malformed line",
+			contentType:      "application/x-ndjson",
+			body:             "{\"url\": \"http://a.com\"}\n{\"url\": \n\n{\"url\": \"http://c.com\", \"title\": \"ignored\"}\n",
+			queueSize:        10,
+			expectedStatus:   http.StatusOK,
+			expectedStatuses: []string{"accepted", "rejected", "accepted"},
+			expectedQueued:   2,
+		},
+		{
+			name:             "full queue rejects the entries that don't fit",
+			contentType:      "application/json",
+			body:             `[{"url": "http://a.com"}, {"url": "http://b.com"}]`,
+			queueSize:        1,
+			expectedStatus:   http.StatusOK,
+			expectedStatuses: []string{"accepted", "rejected"},
+			expectedQueued:   1,
+		},
+		{
+			name:             "stalled queue rejects every entry after it without waiting",
+			contentType:      "application/json",
+			body:             `[{"url": "http://a.com"}, {"url": "http://b.com"}, {"url": "not-a-url"}, {"url": "http://c.com"}]`,
+			queueSize:        1,
+			expectedStatus:   http.StatusOK,
+			expectedStatuses: []string{"accepted", "rejected", "rejected", "rejected"},
+			expectedQueued:   1,
+			expectedTries:    2,
+		},
+		{
+			name:           "not an array",
+			contentType:    "application/json",
+			body:           `{"url": "http://a.com"}`,
+			queueSize:      10,
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			queue := newFakeQueue(tt.queueSize)
+			h := NewHandler(newStore(), queue, nil, nil)
+
+			req := httptest.NewRequest(http.MethodPost, "/submiturls", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", tt.contentType)
+			rr := httptest.NewRecorder()
+			h.SubmitURLs(rr, req)
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %v, got %v: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if rr.Code != http.StatusOK {
+				return
+			}
+
+			var res BulkSubmitResponse
+			if err := json.Unmarshal(rr.Body.Bytes(), &res); err != nil {
+				t.Fatalf("could not unmarshal response: %v", err)
+			}
+			if len(res.Results) != len(tt.expectedStatuses) {
+				t.Fatalf("expected %d results, got %d", len(tt.expectedStatuses), len(res.Results))
+			}
+			for i, result := range res.Results {
+				if result.Index != i || result.Status != tt.expectedStatuses[i] {
+					t.Errorf("expected entry %d to be %s, got %+v", i, tt.expectedStatuses[i], result)
+				}
+				if result.Status == "rejected" && result.Reason == "" {
+					t.Errorf("expected entry %d to have a rejection reason", i)
+				}
+			}
+			if len(queue.urls) != tt.expectedQueued || res.Accepted != tt.expectedQueued {
+				t.Errorf("expected %d queued urls, got %d queued and %d accepted", tt.expectedQueued, len(queue.urls), res.Accepted)
+			}
+			if tt.expectedTries != 0 && queue.tries != tt.expectedTries {
+				t.Errorf("expected %d tries to queue, got %d", tt.expectedTries, queue.tries)
+			}
+		})
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	log.SetOutput(io.Discard)
+	blobs, err := archive.Open(archive.Config{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("could not open archive: %v", err)
+	}
+	w, _ := blobs.Create()
+	io.WriteString(w, "<html>v1</html>")
+	hash, _ := w.Commit()
+
+	s := newStore()
+	s.Update("http://example0.com", store.Attempt{Success: true, SHA256: hash, Blob: hash, ContentType: "text/html"})
+	router := NewRouter(NewHandler(s, newFakeQueue(10), blobs, nil))
+	path := "/urls/" + store.URLID("http://example0.com") + "/snapshots/"
+
+	tests := []struct {
+		name             string
+		path             string
+		acceptEncoding   string
+		expectedStatus   int
+		expectedEncoding string
+	}{
+		{name: "plain", path: path + hash, expectedStatus: http.StatusOK},
+		{name: "gzip", path: path + hash, acceptEncoding: "gzip, deflate", expectedStatus: http.StatusOK, expectedEncoding: "gzip"},
+		{name: "hash of another url", path: path + strings.Repeat("a", 64), expectedStatus: http.StatusNotFound},
+		{name: "unknown url", path: "/urls/unknown/snapshots/" + hash, expectedStatus: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %v, got %v", tt.expectedStatus, rr.Code)
+			}
+			if rr.Code != http.StatusOK {
+				return
+			}
+			if rr.Header().Get("Content-Type") != "text/html" || rr.Header().Get("Content-Encoding") != tt.expectedEncoding {
+				t.Errorf("unexpected headers %v", rr.Header())
+			}
+			// An archived page must not be rendered as part of the api's origin
+			if rr.Header().Get("X-Content-Type-Options") != "nosniff" || rr.Header().Get("Content-Security-Policy") != "sandbox" ||
+				rr.Header().Get("Content-Disposition") != "attachment" {
+				t.Errorf("expected the snapshot to be sandboxed, got headers %v", rr.Header())
+			}
+
+			var body io.Reader = rr.Body
+			if tt.expectedEncoding == "gzip" {
+				if body, err = gzip.NewReader(rr.Body); err != nil {
+					t.Fatalf("expected a gzip body: %v", err)
+				}
+			}
+			if content, _ := io.ReadAll(body); string(content) != "<html>v1</html>" {
+				t.Errorf("expected the archived body, got %q", content)
+			}
+		})
+	}
+
+	// Without an archive there are no snapshots to serve
+	req := httptest.NewRequest(http.MethodGet, path+hash, nil)
+	rr := httptest.NewRecorder()
+	NewRouter(NewHandler(s, newFakeQueue(10), nil, nil)).ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected status %v with archiving disabled, got %v", http.StatusNotFound, rr.Code)
+	}
+}
+
+// TestSubmitURLCanonical ensures submissions are queued under their canonical
+// form along with the form they were submitted in, and that any form finds
+// the stored url
+func TestSubmitURLCanonical(t *testing.T) {
+	s := store.NewMemoryStore(store.Config{})
+	queue := newFakeQueue(10)
+	router := NewRouter(NewHandler(s, queue, nil, canonical.New(canonical.Config{StripParams: []string{"utm_*"}})))
+
+	submitted := "HTTP://Example.com:80/a/../b?utm_source=feed&id=1#top"
+	body := fmt.Sprintf(`{"url": %q}`, submitted)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/submiturl", strings.NewReader(body)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status %v, got %v", http.StatusOK, rr.Code)
+	}
+
+	var res map[string]string
+	if err := json.Unmarshal(rr.Body.Bytes(), &res); err != nil {
+		t.Fatalf("could not unmarshal response: %v", err)
+	}
+	canonicalURL := "http://example.com/b?id=1"
+	if res["url"] != canonicalURL || queue.submitted[canonicalURL] != submitted {
+		t.Fatalf("expected %s to be queued as %s, got %v and %v", submitted, canonicalURL, res, queue.submitted)
+	}
+
+	s.Update(canonicalURL, store.Attempt{Success: true, Submitted: submitted})
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/urls/"+url.PathEscape("http://EXAMPLE.com/b?id=1"), nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected another form of the url to find it, got %v", rr.Code)
+	}
+	var detail URLDetailResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &detail); err != nil {
+		t.Fatalf("could not unmarshal response: %v", err)
+	}
+	if detail.URL != canonicalURL || len(detail.SubmittedAs) != 1 || detail.SubmittedAs[0] != submitted {
+		t.Errorf("unexpected url detail %+v", detail)
+	}
+}
+
+func TestRejected(t *testing.T) {
+	log.SetOutput(io.Discard)
+	s := newStore()
+	s.Update("http://broken.com", store.Attempt{StatusCode: 404, Error: "unexpected status 404 Not Found"})
+	s.Update("http://promoted.com", store.Attempt{Error: "connection refused"})
+	s.Update("http://localhost", store.Attempt{Error: "connection refused"})
+	queue := newFakeQueue(10)
+	router := NewRouter(NewHandler(s, queue, nil, nil))
+
+	// The requests run in order, promoting changes what the later ones see
+	tests := []struct {
+		name           string
+		method         string
+		path           string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{name: "list", method: http.MethodGet, path: "/rejected", expectedStatus: http.StatusOK, expectedBody: `"url":"http://localhost"`},
+		{name: "list with limit", method: http.MethodGet, path: "/rejected?limit=1", expectedStatus: http.StatusOK, expectedBody: `{"rejected":[{"id":"` + store.URLID("http://localhost") + `"`},
+		{name: "invalid limit", method: http.MethodGet, path: "/rejected?limit=zero", expectedStatus: http.StatusBadRequest},
+		{name: "by id", method: http.MethodGet, path: "/rejected/" + store.URLID("http://broken.com"), expectedStatus: http.StatusOK, expectedBody: `"reason":"unexpected status 404 Not Found","status_code":404,"rejections":1,"tries":1`},
+		{name: "by url", method: http.MethodGet, path: "/rejected/" + url.PathEscape("http://broken.com"), expectedStatus: http.StatusOK, expectedBody: `"url":"http://broken.com"`},
+		{name: "stored url", method: http.MethodGet, path: "/rejected/" + url.PathEscape("http://example0.com"), expectedStatus: http.StatusNotFound},
+		{name: "retry", method: http.MethodPost, path: "/rejected/" + url.PathEscape("http://broken.com") + "/retry", expectedStatus: http.StatusOK, expectedBody: `"url":"http://broken.com"`},
+		{name: "retry forbidden", method: http.MethodPost, path: "/rejected/" + url.PathEscape("http://localhost") + "/retry", expectedStatus: http.StatusForbidden},
+		{name: "promote", method: http.MethodPost, path: "/rejected/" + url.PathEscape("http://promoted.com") + "/promote", expectedStatus: http.StatusOK, expectedBody: `"message":"url promoted"`},
+		{name: "promote again", method: http.MethodPost, path: "/rejected/" + url.PathEscape("http://promoted.com") + "/promote", expectedStatus: http.StatusNotFound},
+		{name: "promoted url detail", method: http.MethodGet, path: "/urls/" + url.PathEscape("http://promoted.com"), expectedStatus: http.StatusOK, expectedBody: `"failures":1`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, httptest.NewRequest(tt.method, tt.path, nil))
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %v, got %v: %s", tt.expectedStatus, rr.Code, rr.Body)
+			}
+			if !strings.Contains(rr.Body.String(), tt.expectedBody) {
+				t.Errorf("expected body containing %s, got %s", tt.expectedBody, rr.Body)
+			}
+		})
+	}
+
+	if len(queue.urls) != 1 || <-queue.urls != "http://broken.com" {
+		t.Errorf("expected only http://broken.com to be resubmitted")
+	}
+}
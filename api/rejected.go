@@ -0,0 +1,145 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"spamhaus/store"
+	"strconv"
+)
+
+// defaultRejectedLimit is how many rejected URLs are listed when no limit is
+// given
+const defaultRejectedLimit = 100
+
+// RejectedPage lists rejected URLs, the most recently rejected first
+type RejectedPage struct {
+	Rejected []store.Rejected `json:"rejected"`
+}
+
+// lookupRejected finds a rejected URL by its ID, the URL it was rejected as
+// or any other way of writing that URL
+func (h *Handler) lookupRejected(key string) (store.Rejected, bool) {
+	if r, ok := h.store.GetRejected(key); ok {
+		return r, true
+	}
+	canonicalURL, err := h.canonical(key)
+	if err != nil || canonicalURL == key {
+		return store.Rejected{}, false
+	}
+	return h.store.GetRejected(canonicalURL)
+}
+
+// RejectedURLs lists the URLs discarded because their first download failed
+func (h *Handler) RejectedURLs(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "GET" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	limit := defaultRejectedLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			http.Error(w, fmt.Sprintf("error: invalid limit: %s should be a positive int", value), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	err := json.NewEncoder(w).Encode(RejectedPage{Rejected: h.store.Rejected(limit)})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error: encoding rejected urls: %s", err), http.StatusInternalServerError)
+	}
+
+}
+
+// RejectedURL returns a single rejected URL, given by its ID or as a path
+// escaped URL
+func (h *Handler) RejectedURL(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "GET" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	key := r.PathValue("id")
+	rejected, ok := h.lookupRejected(key)
+	if !ok {
+		http.Error(w, fmt.Sprintf("error: rejected url %s not found", key), http.StatusNotFound)
+		return
+	}
+
+	err := json.NewEncoder(w).Encode(rejected)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error: encoding rejected url: %s", err), http.StatusInternalServerError)
+	}
+
+}
+
+// RetryRejected submits a rejected URL for download again. It stays rejected
+// until the download succeeds, and a failure is counted as another rejection.
+func (h *Handler) RetryRejected(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	key := r.PathValue("id")
+	rejected, ok := h.lookupRejected(key)
+	if !ok {
+		http.Error(w, fmt.Sprintf("error: rejected url %s not found", key), http.StatusNotFound)
+		return
+	}
+	if err := h.tasks.Check(r.Context(), rejected.URL); err != nil {
+		http.Error(w, fmt.Sprintf("error: url not allowed: %s", err), http.StatusForbidden)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), enqueueTimeout)
+	defer cancel()
+	job, err := h.tasks.Submit(ctx, rejected.URL, "")
+	if err != nil {
+		http.Error(w, "error: download queue is full", http.StatusServiceUnavailable)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(map[string]string{"message": "url resubmitted", "job_id": job.ID, "url": rejected.URL})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error: encoding retried url: %s", err), http.StatusInternalServerError)
+	}
+
+}
+
+// PromoteRejected stores a rejected URL without downloading it again, with
+// its failed tries, for URLs known to be worth tracking even though they
+// failed
+func (h *Handler) PromoteRejected(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	key := r.PathValue("id")
+	rejected, ok := h.lookupRejected(key)
+	if !ok {
+		http.Error(w, fmt.Sprintf("error: rejected url %s not found", key), http.StatusNotFound)
+		return
+	}
+	node, ok := h.store.Promote(rejected.URL)
+	if !ok {
+		// It was downloaded, promoted or pruned in the meantime
+		http.Error(w, fmt.Sprintf("error: rejected url %s not found", key), http.StatusNotFound)
+		return
+	}
+
+	err := json.NewEncoder(w).Encode(map[string]string{"message": "url promoted", "id": node.ID, "url": node.URL})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error: encoding promoted url: %s", err), http.StatusInternalServerError)
+	}
+
+}
@@ -7,13 +7,25 @@ import (
 	"net/http"
 )
 
-func Start(port string) (*http.Server, error) {
+// NewRouter registers every API endpoint of the handler
+func NewRouter(handler *Handler) *http.ServeMux {
 	router := http.NewServeMux()
-	router.Handle("/submiturl", http.HandlerFunc(SubmitURL))
-	router.Handle("/topurls", http.HandlerFunc(TopURLs))
+	router.Handle("/submiturl", http.HandlerFunc(handler.SubmitURL))
+	router.Handle("/submiturls", http.HandlerFunc(handler.SubmitURLs))
+	router.Handle("/topurls", http.HandlerFunc(handler.TopURLs))
+	router.Handle("GET /urls/{id}", http.HandlerFunc(handler.URLDetail))
+	router.Handle("GET /urls/{id}/snapshots/{hash}", http.HandlerFunc(handler.Snapshot))
+	router.Handle("GET /jobs/{id}", http.HandlerFunc(handler.JobStatus))
+	router.Handle("GET /rejected", http.HandlerFunc(handler.RejectedURLs))
+	router.Handle("GET /rejected/{id}", http.HandlerFunc(handler.RejectedURL))
+	router.Handle("POST /rejected/{id}/retry", http.HandlerFunc(handler.RetryRejected))
+	router.Handle("POST /rejected/{id}/promote", http.HandlerFunc(handler.PromoteRejected))
+	return router
+}
 
+func Start(port string, handler *Handler) (*http.Server, error) {
 	httpServer := &http.Server{
-		Handler: router,
+		Handler: NewRouter(handler),
 		Addr:    fmt.Sprintf("%s", port),
 	}
 
@@ -0,0 +1,103 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"spamhaus/archive"
+	"spamhaus/store"
+	"strings"
+)
+
+// Snapshot serves an archived body of a URL. The hash has to be one the URL
+// was downloaded as, either in its recent history or its change timeline.
+// If the client accepts gzip the blob is sent as it is stored.
+func (h *Handler) Snapshot(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "GET" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	if h.archive == nil {
+		http.Error(w, "error: archiving is disabled", http.StatusNotFound)
+		return
+	}
+
+	key, hash := r.PathValue("id"), strings.ToLower(r.PathValue("hash"))
+	node, ok := h.lookup(key)
+	if !ok {
+		http.Error(w, fmt.Sprintf("error: url %s not found", key), http.StatusNotFound)
+		return
+	}
+	contentType, ok := snapshotContentType(node.Data, hash)
+	if !ok {
+		http.Error(w, fmt.Sprintf("error: no snapshot %s of url %s", hash, key), http.StatusNotFound)
+		return
+	}
+
+	compressed := acceptsGzip(r)
+	var body io.ReadCloser
+	var err error
+	if compressed {
+		body, err = h.archive.OpenCompressed(hash)
+	} else {
+		body, err = h.archive.Open(hash)
+	}
+	if errors.Is(err, archive.ErrNotFound) {
+		http.Error(w, fmt.Sprintf("error: snapshot %s is no longer archived", hash), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error: reading snapshot: %s", err), http.StatusInternalServerError)
+		return
+	}
+	defer body.Close()
+
+	// The body is whatever the URL served, so it mustn't run as a page of
+	// this origin, where its scripts could reach the API
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.Header().Set("Content-Disposition", "attachment")
+	w.Header().Set("ETag", `"`+hash+`"`)
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set("Vary", "Accept-Encoding")
+	if compressed {
+		w.Header().Set("Content-Encoding", "gzip")
+	}
+	io.Copy(w, body)
+
+}
+
+// snapshotContentType looks for the hash among the URL's downloads and
+// returns the content type it was served with
+func snapshotContentType(data *store.URLData, hash string) (string, bool) {
+	contentType, found := "", false
+	for _, attempt := range data.History.Attempts() {
+		if attempt.Blob == hash {
+			contentType, found = attempt.ContentType, true
+		}
+	}
+	for _, change := range data.Changes {
+		if change.SHA256 == hash {
+			found = true
+		}
+	}
+
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	return contentType, found
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, encoding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(encoding), ";")
+		if strings.EqualFold(strings.TrimSpace(name), "gzip") && strings.ReplaceAll(params, " ", "") != "q=0" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,296 @@
+// Package archive keeps downloaded bodies on disk. Bodies are stored gzip
+// compressed under the hex SHA-256 of their content, so a body downloaded
+// many times is only stored once.
+package archive
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	blobSuffix    = ".gz"
+	tempDir       = "tmp"
+	pruneInterval = time.Minute
+)
+
+// ErrNotFound is returned for a hash that isn't in the archive, either
+// because it never was or because it has been evicted
+var ErrNotFound = errors.New("archive: blob not found")
+
+// Config holds the archive section of config.yaml. A zero MaxSizeMB or
+// RetentionSeconds leaves that limit off.
+type Config struct {
+	Enabled bool   `yaml:"enabled"`
+	Dir     string `yaml:"dir"`
+	// MaxSizeMB caps the compressed size of the archive, the least
+	// recently stored blobs are evicted to stay under it
+	MaxSizeMB int `yaml:"max_size_mb"`
+	// RetentionSeconds is how long a blob is kept after it was last stored
+	RetentionSeconds int `yaml:"retention_seconds"`
+}
+
+type blob struct {
+	size int64
+	used time.Time
+}
+
+// Archive is a directory of content addressed blobs. It is safe for
+// concurrent use.
+type Archive struct {
+	dir       string
+	maxBytes  int64
+	retention time.Duration
+
+	mu        sync.Mutex
+	blobs     map[string]*blob
+	total     int64
+	lastPrune time.Time
+}
+
+// Open indexes the blobs already in cfg.Dir, creating it if needed, and
+// applies the retention and size limits to them.
+func Open(cfg Config) (*Archive, error) {
+	if cfg.Dir == "" {
+		return nil, errors.New("archive: dir is required")
+	}
+	if err := os.MkdirAll(filepath.Join(cfg.Dir, tempDir), 0o755); err != nil {
+		return nil, fmt.Errorf("archive: creating dir: %w", err)
+	}
+
+	a := &Archive{
+		dir:       cfg.Dir,
+		maxBytes:  int64(cfg.MaxSizeMB) * 1024 * 1024,
+		retention: time.Duration(cfg.RetentionSeconds) * time.Second,
+		blobs:     make(map[string]*blob),
+	}
+
+	// Anything left in tmp was being written when the process stopped
+	temps, _ := os.ReadDir(filepath.Join(cfg.Dir, tempDir))
+	for _, temp := range temps {
+		os.Remove(filepath.Join(cfg.Dir, tempDir, temp.Name()))
+	}
+
+	err := filepath.WalkDir(cfg.Dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		hash, ok := strings.CutSuffix(entry.Name(), blobSuffix)
+		if !ok || !validHash(hash) {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		a.blobs[hash] = &blob{size: info.Size(), used: info.ModTime()}
+		a.total += info.Size()
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("archive: indexing %s: %w", cfg.Dir, err)
+	}
+
+	a.mu.Lock()
+	a.prune(time.Now())
+	a.mu.Unlock()
+	log.Printf("archive: %d blobs, %d bytes in %s", len(a.blobs), a.total, cfg.Dir)
+	return a, nil
+}
+
+// Writer streams a body into the archive. Nothing is stored until Commit.
+type Writer struct {
+	archive *Archive
+	file    *os.File
+	gz      *gzip.Writer
+	hash    hash.Hash
+}
+
+// Create starts writing a new body
+func (a *Archive) Create() (*Writer, error) {
+	file, err := os.CreateTemp(filepath.Join(a.dir, tempDir), "blob-*")
+	if err != nil {
+		return nil, fmt.Errorf("archive: creating blob: %w", err)
+	}
+	return &Writer{archive: a, file: file, gz: gzip.NewWriter(file), hash: sha256.New()}, nil
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	w.hash.Write(p)
+	return w.gz.Write(p)
+}
+
+// Commit stores the body written so far under its hash and returns the hash.
+// If the body is already archived the copy just written is dropped.
+func (w *Writer) Commit() (string, error) {
+	err := w.gz.Close()
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(w.file.Name())
+		return "", fmt.Errorf("archive: writing blob: %w", err)
+	}
+
+	sum := hex.EncodeToString(w.hash.Sum(nil))
+	if err := w.archive.add(sum, w.file.Name()); err != nil {
+		os.Remove(w.file.Name())
+		return "", err
+	}
+	return sum, nil
+}
+
+// Abort throws away the body written so far
+func (w *Writer) Abort() {
+	w.gz.Close()
+	w.file.Close()
+	os.Remove(w.file.Name())
+}
+
+// add moves a finished temp file into place as the blob for hash
+func (a *Archive) add(hash, temp string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	path := a.path(hash)
+	if existing, ok := a.blobs[hash]; ok {
+		os.Remove(temp)
+		existing.used = now
+		os.Chtimes(path, now, now)
+		a.prune(now)
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("archive: creating blob dir: %w", err)
+	}
+	info, err := os.Stat(temp)
+	if err != nil {
+		return fmt.Errorf("archive: storing blob: %w", err)
+	}
+	if err := os.Rename(temp, path); err != nil {
+		return fmt.Errorf("archive: storing blob: %w", err)
+	}
+
+	a.blobs[hash] = &blob{size: info.Size(), used: now}
+	a.total += info.Size()
+	a.prune(now)
+	if _, ok := a.blobs[hash]; !ok {
+		return fmt.Errorf("archive: blob %s is bigger than the archive's size limit", hash)
+	}
+	return nil
+}
+
+// prune removes blobs past their retention, at most once a minute, and then
+// the least recently stored ones while the archive is over its size limit.
+// Must be called with the lock held.
+func (a *Archive) prune(now time.Time) {
+	if a.retention > 0 && now.Sub(a.lastPrune) >= pruneInterval {
+		a.lastPrune = now
+		for hash, b := range a.blobs {
+			if now.Sub(b.used) > a.retention {
+				a.remove(hash)
+			}
+		}
+	}
+
+	if a.maxBytes <= 0 || a.total <= a.maxBytes {
+		return
+	}
+	hashes := make([]string, 0, len(a.blobs))
+	for hash := range a.blobs {
+		hashes = append(hashes, hash)
+	}
+	sort.Slice(hashes, func(i, j int) bool { return a.blobs[hashes[i]].used.Before(a.blobs[hashes[j]].used) })
+	for _, hash := range hashes {
+		if a.total <= a.maxBytes {
+			break
+		}
+		a.remove(hash)
+	}
+}
+
+// remove deletes a blob. Must be called with the lock held.
+func (a *Archive) remove(hash string) {
+	if err := os.Remove(a.path(hash)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("archive: removing blob %s: %v", hash, err)
+		return
+	}
+	a.total -= a.blobs[hash].size
+	delete(a.blobs, hash)
+}
+
+// Has reports whether a blob is archived
+func (a *Archive) Has(hash string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, ok := a.blobs[hash]
+	return ok
+}
+
+// OpenCompressed returns the gzip compressed blob as it is stored
+func (a *Archive) OpenCompressed(hash string) (io.ReadCloser, error) {
+	if !validHash(hash) {
+		return nil, ErrNotFound
+	}
+	file, err := os.Open(a.path(hash))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// Open returns the decompressed blob
+func (a *Archive) Open(hash string) (io.ReadCloser, error) {
+	file, err := a.OpenCompressed(hash)
+	if err != nil {
+		return nil, err
+	}
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("archive: reading blob %s: %w", hash, err)
+	}
+	return &blobReader{Reader: gz, file: file}, nil
+}
+
+type blobReader struct {
+	*gzip.Reader
+	file io.Closer
+}
+
+func (r *blobReader) Close() error {
+	r.Reader.Close()
+	return r.file.Close()
+}
+
+// path shards blobs into directories by the first two characters of their
+// hash so no single directory gets too big
+func (a *Archive) path(hash string) string {
+	return filepath.Join(a.dir, hash[:2], hash+blobSuffix)
+}
+
+func validHash(hash string) bool {
+	if len(hash) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil && strings.ToLower(hash) == hash
+}
@@ -0,0 +1,116 @@
+package archive
+
+import (
+	"io"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+func store(t *testing.T, a *Archive, body string) string {
+	t.Helper()
+	w, err := a.Create()
+	if err != nil {
+		t.Fatalf("could not create blob: %v", err)
+	}
+	io.WriteString(w, body)
+	hash, err := w.Commit()
+	if err != nil {
+		t.Fatalf("could not commit blob: %v", err)
+	}
+	return hash
+}
+
+func read(t *testing.T, a *Archive, hash string) string {
+	t.Helper()
+	r, err := a.Open(hash)
+	if err != nil {
+		t.Fatalf("could not open blob %s: %v", hash, err)
+	}
+	defer r.Close()
+	body, _ := io.ReadAll(r)
+	return string(body)
+}
+
+// TestArchive ensures bodies are deduplicated by hash and found again after
+// the archive is reopened
+func TestArchive(t *testing.T) {
+	log.SetOutput(io.Discard)
+	dir := t.TempDir()
+
+	a, err := Open(Config{Dir: dir})
+	if err != nil {
+		t.Fatalf("could not open archive: %v", err)
+	}
+	first := store(t, a, "hello world")
+	second := store(t, a, "hello world")
+	other := store(t, a, "goodbye")
+
+	if first != second || first == other {
+		t.Errorf("expected equal bodies to share a hash, got %s %s %s", first, second, other)
+	}
+	if first != "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9" {
+		t.Errorf("expected the sha256 of the body, got %s", first)
+	}
+	if len(a.blobs) != 2 {
+		t.Errorf("expected 2 blobs, got %d", len(a.blobs))
+	}
+
+	a.Create()
+	reopened, err := Open(Config{Dir: dir})
+	if err != nil {
+		t.Fatalf("could not reopen archive: %v", err)
+	}
+	if body := read(t, reopened, first); body != "hello world" {
+		t.Errorf("expected the archived body back, got %q", body)
+	}
+	if reopened.total != a.total || len(reopened.blobs) != 2 {
+		t.Errorf("expected the reopened archive to index the same %d bytes, got %d", a.total, reopened.total)
+	}
+	if temps, _ := os.ReadDir(dir + "/tmp"); len(temps) != 0 {
+		t.Errorf("expected unfinished blobs to be cleaned up, got %d", len(temps))
+	}
+
+	for _, hash := range []string{"../../etc/passwd", strings.Repeat("0", 64)} {
+		if _, err := reopened.Open(hash); err != ErrNotFound {
+			t.Errorf("expected %s not to be found, got %v", hash, err)
+		}
+	}
+}
+
+// TestArchiveQuota ensures the least recently stored blobs are evicted to
+// keep the archive under its size limit
+func TestArchiveQuota(t *testing.T) {
+	log.SetOutput(io.Discard)
+	a, err := Open(Config{Dir: t.TempDir(), MaxSizeMB: 1})
+	if err != nil {
+		t.Fatalf("could not open archive: %v", err)
+	}
+
+	// Random looking bodies don't compress, so each takes about 400KB
+	body := func(seed byte) string {
+		b := make([]byte, 400*1024)
+		x := uint32(seed) + 1
+		for i := range b {
+			x ^= x << 13
+			x ^= x >> 17
+			x ^= x << 5
+			b[i] = byte(x)
+		}
+		return string(b)
+	}
+
+	first := store(t, a, body(1))
+	second := store(t, a, body(2))
+	// Storing the first again makes the second the least recently stored
+	store(t, a, body(1))
+	third := store(t, a, body(3))
+
+	if !a.Has(first) || a.Has(second) || !a.Has(third) {
+		t.Errorf("expected only the least recently stored blob to be evicted")
+	}
+	if a.total > 1024*1024 {
+		t.Errorf("expected the archive to stay under 1MB, got %d bytes", a.total)
+	}
+}
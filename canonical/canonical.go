@@ -0,0 +1,209 @@
+// Package canonical rewrites URLs into a canonical form, so the different
+// ways of writing the same URL are counted as one.
+package canonical
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Config holds the canonical section of config.yaml
+type Config struct {
+	// StripParams names query parameters dropped from URLs, such as tracking
+	// parameters. A name ending in * drops every parameter starting with it.
+	StripParams []string `yaml:"strip_params"`
+}
+
+// defaultPorts are left out of canonical URLs
+var defaultPorts = map[string]string{"http": "80", "https": "443"}
+
+// Canonicalizer rewrites URLs into their canonical form. The zero value
+// strips no query parameters.
+type Canonicalizer struct {
+	exact    map[string]bool
+	prefixes []string
+}
+
+func New(cfg Config) *Canonicalizer {
+	c := &Canonicalizer{exact: make(map[string]bool)}
+	for _, param := range cfg.StripParams {
+		if prefix, ok := strings.CutSuffix(param, "*"); ok {
+			c.prefixes = append(c.prefixes, prefix)
+		} else {
+			c.exact[param] = true
+		}
+	}
+	return c
+}
+
+// URL returns the canonical form of an absolute URL: the scheme and host are
+// lower case, the host is in its ASCII form and the default port is left
+// out, dot segments are removed from the path, percent encoding is only used
+// where it is needed and always in upper case, the stripped query parameters
+// and the fragment are gone.
+func (c *Canonicalizer) URL(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return "", errors.New("canonical: url is not absolute")
+	}
+
+	u.Scheme = strings.ToLower(u.Scheme)
+	host, err := c.host(u.Hostname())
+	if err != nil {
+		return "", err
+	}
+	if port := u.Port(); port != "" && port != defaultPorts[u.Scheme] {
+		host += ":" + port
+	}
+	u.Host = host
+
+	path := normalizeEscapes(u.EscapedPath(), pathSafe)
+	path = removeDotSegments(path)
+	if path == "" {
+		path = "/"
+	}
+	u.RawPath, u.Path = path, ""
+	if u.Path, err = url.PathUnescape(path); err != nil {
+		return "", err
+	}
+
+	u.RawQuery = c.query(u.RawQuery)
+	u.ForceQuery = false
+	u.Fragment, u.RawFragment = "", ""
+	return u.String(), nil
+}
+
+// host lower cases the host name and encodes it as punycode where needed
+func (c *Canonicalizer) host(host string) (string, error) {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if strings.Contains(host, ":") {
+		// An IPv6 address
+		return "[" + host + "]", nil
+	}
+	ascii, err := toASCII(host)
+	if err != nil {
+		return "", fmt.Errorf("canonical: invalid host %s: %w", host, err)
+	}
+	return ascii, nil
+}
+
+// query drops the stripped parameters from a raw query, keeping the order of
+// the rest
+func (c *Canonicalizer) query(rawQuery string) string {
+	if rawQuery == "" {
+		return ""
+	}
+
+	var kept []string
+	for _, param := range strings.Split(rawQuery, "&") {
+		if param == "" {
+			continue
+		}
+		name, _, _ := strings.Cut(param, "=")
+		if decoded, err := url.QueryUnescape(name); err == nil && c.stripped(decoded) {
+			continue
+		}
+		kept = append(kept, normalizeEscapes(param, querySafe))
+	}
+	return strings.Join(kept, "&")
+}
+
+func (c *Canonicalizer) stripped(name string) bool {
+	if c.exact[name] {
+		return true
+	}
+	for _, prefix := range c.prefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// removeDotSegments resolves the . and .. segments of a path as in section
+// 5.2.4 of RFC 3986. Unlike path.Clean it keeps empty segments and trailing
+// slashes, which servers may treat as different resources.
+func removeDotSegments(path string) string {
+	if !strings.Contains(path, ".") {
+		return path
+	}
+
+	segments := strings.Split(path, "/")
+	out := make([]string, 0, len(segments))
+	for i, segment := range segments {
+		last := i == len(segments)-1
+		switch segment {
+		case ".":
+			if last {
+				out = append(out, "")
+			}
+		case "..":
+			if len(out) > 1 {
+				out = out[:len(out)-1]
+			}
+			if last {
+				out = append(out, "")
+			}
+		default:
+			out = append(out, segment)
+		}
+	}
+	return strings.Join(out, "/")
+}
+
+// Characters, besides the unreserved ones, left as they are in a path or a
+// query parameter. The rest are percent encoded.
+const (
+	pathSafe  = "/!$&'()*+,;=:@"
+	querySafe = "/?!$'()*+,;=:@"
+)
+
+// normalizeEscapes decodes percent encoded unreserved characters, upper cases
+// the remaining escapes and encodes the characters that need it. Escapes of
+// reserved characters are kept as they change the meaning of the URL.
+func normalizeEscapes(s, safe string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		if ch == '%' && i+2 < len(s) && isHex(s[i+1]) && isHex(s[i+2]) {
+			decoded := unhex(s[i+1])<<4 | unhex(s[i+2])
+			if isUnreserved(decoded) {
+				b.WriteByte(decoded)
+			} else {
+				b.WriteString(strings.ToUpper(s[i : i+3]))
+			}
+			i += 2
+			continue
+		}
+		if isUnreserved(ch) || strings.IndexByte(safe, ch) >= 0 {
+			b.WriteByte(ch)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", ch)
+	}
+	return b.String()
+}
+
+func isUnreserved(ch byte) bool {
+	return 'a' <= ch && ch <= 'z' || 'A' <= ch && ch <= 'Z' || '0' <= ch && ch <= '9' ||
+		ch == '-' || ch == '.' || ch == '_' || ch == '~'
+}
+
+func isHex(ch byte) bool {
+	return '0' <= ch && ch <= '9' || 'a' <= ch && ch <= 'f' || 'A' <= ch && ch <= 'F'
+}
+
+func unhex(ch byte) byte {
+	switch {
+	case ch >= 'a':
+		return ch - 'a' + 10
+	case ch >= 'A':
+		return ch - 'A' + 10
+	}
+	return ch - '0'
+}
@@ -0,0 +1,134 @@
+package canonical
+
+import (
+	"errors"
+	"strings"
+	"unicode/utf8"
+)
+
+// Punycode parameters from RFC 3492
+const (
+	punyBase        = 36
+	punyTMin        = 1
+	punyTMax        = 26
+	punySkew        = 38
+	punyDamp        = 700
+	punyInitialBias = 72
+	punyInitialN    = 128
+	acePrefix       = "xn--"
+)
+
+var errPunycodeOverflow = errors.New("canonical: punycode overflow")
+
+// toASCII converts an internationalised host name to its ASCII form by
+// encoding every label that isn't ASCII as punycode
+func toASCII(host string) (string, error) {
+	labels := strings.Split(host, ".")
+	for i, label := range labels {
+		if isASCII(label) {
+			continue
+		}
+		encoded, err := punycode(label)
+		if err != nil {
+			return "", err
+		}
+		labels[i] = acePrefix + encoded
+	}
+	return strings.Join(labels, "."), nil
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// punycode encodes a label as described in section 6.3 of RFC 3492
+func punycode(label string) (string, error) {
+	input := []rune(label)
+	var out strings.Builder
+	for _, r := range input {
+		if r < utf8.RuneSelf {
+			out.WriteRune(r)
+		}
+	}
+	basic := out.Len()
+	handled := basic
+	if basic > 0 {
+		out.WriteByte('-')
+	}
+
+	n, delta, bias := rune(punyInitialN), 0, punyInitialBias
+	for handled < len(input) {
+		// The smallest code point not handled yet
+		m := rune(utf8.MaxRune)
+		for _, r := range input {
+			if r >= n && r < m {
+				m = r
+			}
+		}
+		if int(m-n) > (1<<31-1-delta)/(handled+1) {
+			return "", errPunycodeOverflow
+		}
+		delta += int(m-n) * (handled + 1)
+		n = m
+
+		for _, r := range input {
+			if r < n {
+				delta++
+				if delta < 0 {
+					return "", errPunycodeOverflow
+				}
+			}
+			if r != n {
+				continue
+			}
+			q := delta
+			for k := punyBase; ; k += punyBase {
+				t := k - bias
+				if t < punyTMin {
+					t = punyTMin
+				} else if t > punyTMax {
+					t = punyTMax
+				}
+				if q < t {
+					break
+				}
+				out.WriteByte(punyDigit(t + (q-t)%(punyBase-t)))
+				q = (q - t) / (punyBase - t)
+			}
+			out.WriteByte(punyDigit(q))
+			bias = punyAdapt(delta, handled+1, handled == basic)
+			delta = 0
+			handled++
+		}
+		delta++
+		n++
+	}
+	return out.String(), nil
+}
+
+func punyDigit(d int) byte {
+	if d < 26 {
+		return byte('a' + d)
+	}
+	return byte('0' + d - 26)
+}
+
+func punyAdapt(delta, points int, first bool) int {
+	if first {
+		delta /= punyDamp
+	} else {
+		delta /= 2
+	}
+	delta += delta / points
+	k := 0
+	for delta > ((punyBase-punyTMin)*punyTMax)/2 {
+		delta /= punyBase - punyTMin
+		k += punyBase
+	}
+	return k + (punyBase-punyTMin+1)*delta/(delta+punySkew)
+}
@@ -6,7 +6,10 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"slices"
 	"spamhaus/api"
+	"spamhaus/archive"
+	"spamhaus/canonical"
 	"spamhaus/downloader"
 	"spamhaus/store"
 	"syscall"
@@ -18,11 +21,13 @@ type Config struct {
 		Port string `yaml:"port"`
 	} `yaml:"server"`
 
-	Downloader struct {
-		WorkerPoolSize       int `yaml:"worker_pool_size"`
-		NumOfBatchURLs       int `yaml:"num_of_batch_urls"`
-		BatchIntervalSeconds int `yaml:"batch_interval_seconds"`
-	} `yaml:"downloader"`
+	Store store.Config `yaml:"store"`
+
+	Archive archive.Config `yaml:"archive"`
+
+	Canonical canonical.Config `yaml:"canonical"`
+
+	Downloader downloader.Config `yaml:"downloader"`
 }
 
 func main() {
@@ -31,7 +36,23 @@ func main() {
 		log.Fatalf("error loading config: %v", err)
 	}
 
-	store.New()
+	urlStore, err := store.New(config.Store)
+	if err != nil {
+		log.Fatalf("error starting store: %v", err)
+	}
+
+	var blobs *archive.Archive
+	if config.Archive.Enabled {
+		blobs, err = archive.Open(config.Archive)
+		if err != nil {
+			log.Fatalf("error opening archive: %v", err)
+		}
+	}
+
+	workerPool, err := downloader.NewWorkerPool(config.Downloader, urlStore, blobs)
+	if err != nil {
+		log.Fatalf("error starting worker pool: %v", err)
+	}
 
 	mux := http.NewServeMux()
 	server := &http.Server{
@@ -41,16 +62,23 @@ func main() {
 
 	go server.ListenAndServe()
 
-	httpServer, err := api.Start(config.Server.Port)
+	httpServer, err := api.Start(config.Server.Port, api.NewHandler(urlStore, workerPool, blobs, canonical.New(config.Canonical)))
 	if err != nil {
 		log.Fatalf("error starting http server: %v", err)
 	}
 
-	downloader.NewBatchProcess(
-		time.Duration(config.Downloader.BatchIntervalSeconds),
-		config.Downloader.WorkerPoolSize,
+	batchWindow := time.Duration(config.Downloader.BatchWindowSeconds) * time.Second
+	if batchWindow != 0 && !slices.Contains(urlStore.Windows(), batchWindow) {
+		log.Fatalf("error starting batch process: batch_window_seconds %d is not one of the store's windows_seconds", config.Downloader.BatchWindowSeconds)
+	}
+	batchProcess := downloader.NewBatchProcess(
+		time.Duration(config.Downloader.BatchIntervalSeconds)*time.Second,
+		workerPool,
+		urlStore,
 		config.Downloader.NumOfBatchURLs,
+		batchWindow,
 	)
+	batchProcess.Run()
 
 	shutdown := make(chan os.Signal, 1)
 
@@ -64,7 +92,9 @@ func main() {
 
 	<-shutdown
 	api.Shutdown(httpServer)
-	store.Shutdown()
+	batchProcess.Stop()
+	workerPool.Shutdown()
+	urlStore.Shutdown()
 
 }
 
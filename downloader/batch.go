@@ -1,6 +1,7 @@
 package downloader
 
 import (
+	"fmt"
 	"log"
 	"spamhaus/store"
 	"time"
@@ -8,52 +9,84 @@ import (
 
 type BatchProcess struct {
 	workerPool   *WorkerPool
-	concurrency  int
+	store        store.Store
 	interval     time.Duration
 	numberOfURLs int
+	window       time.Duration
+	stop         chan struct{}
+	stopped      chan struct{}
 }
 
-var batchProcessor BatchProcess
-
-func NewBatchProcess(interval time.Duration, poolSize, numberOfURLS int) {
-	workerPool := NewWorkerPool(3)
-	batchProcessor = BatchProcess{
+// NewBatchProcess creates a batch process that refetches the top
+// numberOfURLS urls in the store through the given worker pool, ranked by
+// their submissions over window, one of the store's windows, or ever if it
+// is 0
+func NewBatchProcess(interval time.Duration, workerPool *WorkerPool, s store.Store, numberOfURLS int, window time.Duration) *BatchProcess {
+	return &BatchProcess{
 		workerPool:   workerPool,
-		concurrency:  poolSize,
+		store:        s,
 		interval:     interval,
 		numberOfURLs: numberOfURLS,
+		window:       window,
+		stop:         make(chan struct{}),
+		stopped:      make(chan struct{}),
 	}
-	batchProcessor.Run()
 }
 
 func (b *BatchProcess) Run() {
 	go func() {
+		defer close(b.stopped)
 		for {
 			b.runJob()
-			time.Sleep(time.Second * b.interval)
+			select {
+			case <-time.After(b.interval):
+			case <-b.stop:
+				return
+			}
 		}
 	}()
 }
 
+// Stop waits for the running batch job to finish and stops any more from
+// being scheduled
+func (b *BatchProcess) Stop() {
+	log.Println("batch: stopping batch process")
+	close(b.stop)
+	<-b.stopped
+}
+
 func (b *BatchProcess) runJob() {
 	log.Println("batch: starting batch process")
 
-	topURLs := store.Filter(b.numberOfURLs, "")
+	topURLs := b.store.Filter(store.Query{Limit: b.numberOfURLs, SortBy: store.SortCount, Window: b.window})
 	if len(topURLs) == 0 {
 		log.Println("batch: no urls to process")
 		return
 	}
 
+	started := time.Now()
+	urls := make([]string, 0, len(topURLs))
 	for _, url := range topURLs {
-		AddTask(url.URL)
+		urls = append(urls, url.URL)
 	}
 
-	b.workerPool.Wait()
+	b.workerPool.Refetch(urls)
 	log.Println("batch: finished batch process")
-	b.logStats(topURLs)
+
+	// Read the records again so the stats include this batch's downloads
+	processed := make([]*store.URLNode, 0, len(topURLs))
+	for _, url := range topURLs {
+		if node, ok := b.store.Get(url.URL); ok {
+			processed = append(processed, node)
+		}
+	}
+	b.logStats(processed, started)
 }
 
-func (b *BatchProcess) logStats(topURLS []*store.URLNode) {
+// logStats prints the stats of every URL in the batch, including the mean
+// time of each download phase, flagging those whose content changed since
+// the batch started and those the server said were not modified
+func (b *BatchProcess) logStats(topURLS []*store.URLNode, started time.Time) {
 	log.Println("----- Batch Job Stats -----")
 
 	if len(topURLS) == 0 {
@@ -61,11 +94,29 @@ func (b *BatchProcess) logStats(topURLS []*store.URLNode) {
 		return
 	}
 
+	changed, notModified := 0, 0
 	for _, node := range topURLS {
 		data := node.Data
-		log.Printf("URL: %s | Count: %d | Successes: %d | Failures: %d | Last Download Time: %dms",
-			node.URL, data.Count, data.Successes, data.Failures, data.LastDownloadMs)
+		latency := data.History.Stats()
+		flag := ""
+		switch last := data.LastResponse; {
+		case !data.LastChanged.Before(started):
+			changed++
+			flag = " | CHANGED"
+		case last != nil && last.NotModified() && !last.At.Before(started):
+			notModified++
+			flag = " | NOT MODIFIED"
+		}
+		phases := ""
+		if p := latency.Phases; p != nil {
+			phases = fmt.Sprintf(" | DNS: %.0fms | Connect: %.0fms | TLS: %.0fms | TTFB: %.0fms | Transfer: %.0fms",
+				p.DNSMs, p.ConnectMs, p.TLSMs, p.TTFBMs, p.TransferMs)
+		}
+		log.Printf("URL: %s | Count: %d | Fetches: %d | Successes: %d | Failures: %d | Last Download Time: %dms | p50: %dms | p90: %dms | p99: %dms | Min: %dms | Max: %dms%s | Changes: %d%s",
+			node.URL, data.Count, data.Fetches, data.Successes, data.Failures, data.LastDownloadMs,
+			latency.P50Ms, latency.P90Ms, latency.P99Ms, latency.MinMs, latency.MaxMs, phases, data.ChangeCount, flag)
 	}
+	log.Printf("batch: %d of %d urls changed, %d not modified", changed, len(topURLS), notModified)
 
 	log.Println("----------------")
 }
@@ -0,0 +1,128 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+const defaultThroughputWindow = 10 * time.Second
+
+// BodyConfig limits how much a single download may read and for how long,
+// so a huge or trickling body can't tie up a worker. Zero values leave that
+// limit off.
+type BodyConfig struct {
+	MaxBytes int64 `yaml:"max_bytes"`
+	// MaxDurationSeconds bounds a download from sending the request to the
+	// end of the body. It has to be below the client's timeout, which would
+	// otherwise end the download first.
+	MaxDurationSeconds int `yaml:"max_duration_seconds"`
+	// MinBytesPerSecond aborts downloads that read less than this on average
+	// over any ThroughputWindowSeconds, which defaults to 10
+	MinBytesPerSecond       int64 `yaml:"min_bytes_per_second"`
+	ThroughputWindowSeconds int   `yaml:"throughput_window_seconds"`
+}
+
+// abortError is why a download was cut short by a BodyConfig limit
+type abortError struct {
+	reason string
+}
+
+func (e *abortError) Error() string {
+	return "aborted: " + e.reason
+}
+
+// bodyLimiter enforces a BodyConfig on one download. The time limits cancel
+// the request's context, so they also catch a server that stops sending
+// altogether. The throughput check only starts with the body, so waiting
+// for the response headers, which response_header_timeout bounds, doesn't
+// count as reading nothing.
+type bodyLimiter struct {
+	config BodyConfig
+	ctx    context.Context
+	body   io.Reader
+	read   atomic.Int64
+	cancel context.CancelCauseFunc
+	stop   func()
+}
+
+// limitBody starts enforcing cfg on the download made with the returned
+// context. finish has to be called once the download is over.
+func limitBody(ctx context.Context, cfg BodyConfig) (context.Context, *bodyLimiter) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	stop := context.CancelFunc(func() {})
+	if cfg.MaxDurationSeconds > 0 {
+		abort := &abortError{fmt.Sprintf("download took longer than %ds", cfg.MaxDurationSeconds)}
+		ctx, stop = context.WithTimeoutCause(ctx, time.Duration(cfg.MaxDurationSeconds)*time.Second, abort)
+	}
+
+	return ctx, &bodyLimiter{config: cfg, ctx: ctx, cancel: cancel, stop: stop}
+}
+
+// watch aborts the download if it reads less than the minimum throughput
+// over a window
+func (l *bodyLimiter) watch(window time.Duration) {
+	ticker := time.NewTicker(window)
+	defer ticker.Stop()
+
+	var last int64
+	for {
+		select {
+		case <-l.ctx.Done():
+			return
+		case <-ticker.C:
+			read := l.read.Load()
+			if float64(read-last)/window.Seconds() < float64(l.config.MinBytesPerSecond) {
+				l.cancel(&abortError{fmt.Sprintf("download slower than %d bytes/s", l.config.MinBytesPerSecond)})
+				return
+			}
+			last = read
+		}
+	}
+}
+
+// wrap returns body limited to the configured size and starts checking the
+// throughput it is read at
+func (l *bodyLimiter) wrap(body io.Reader) io.Reader {
+	l.body = body
+	if l.config.MinBytesPerSecond > 0 {
+		go l.watch(seconds(l.config.ThroughputWindowSeconds, defaultThroughputWindow))
+	}
+	return l
+}
+
+func (l *bodyLimiter) Read(p []byte) (int, error) {
+	max := l.config.MaxBytes
+	if max <= 0 {
+		n, err := l.body.Read(p)
+		l.read.Add(int64(n))
+		return n, err
+	}
+
+	// Read one byte past the limit to tell a body of exactly max bytes from
+	// a bigger one
+	if remaining := max + 1 - l.read.Load(); int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	n, err := l.body.Read(p)
+	if read := l.read.Add(int64(n)); read > max {
+		abort := &abortError{fmt.Sprintf("body is larger than %d bytes", max)}
+		l.cancel(abort)
+		return n - int(read-max), abort
+	}
+	return n, err
+}
+
+// finish releases the limits and returns the error that ended the download,
+// replaced by the reason if a limit aborted it
+func (l *bodyLimiter) finish(err error) error {
+	abort, aborted := context.Cause(l.ctx).(*abortError)
+	l.stop()
+	l.cancel(nil)
+	if aborted {
+		return abort
+	}
+	return err
+}
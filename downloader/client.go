@@ -0,0 +1,159 @@
+package downloader
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+const (
+	defaultConnectTimeout        = 10 * time.Second
+	defaultTLSHandshakeTimeout   = 10 * time.Second
+	defaultResponseHeaderTimeout = 30 * time.Second
+	defaultTimeout               = 60 * time.Second
+	defaultMaxRedirects          = 10
+	defaultUserAgent             = "url-downloader/1.0"
+)
+
+// ClientConfig configures the HTTP client used for every download. Zero
+// values fall back to the defaults above rather than to no limit at all, so
+// a hanging server can't hold on to a worker forever.
+type ClientConfig struct {
+	ConnectTimeoutSeconds        int `yaml:"connect_timeout_seconds"`
+	TLSHandshakeTimeoutSeconds   int `yaml:"tls_handshake_timeout_seconds"`
+	ResponseHeaderTimeoutSeconds int `yaml:"response_header_timeout_seconds"`
+	// TimeoutSeconds bounds the whole download including reading the body
+	TimeoutSeconds int `yaml:"timeout_seconds"`
+	// MaxRedirects is how many redirects are followed, a negative value
+	// returns the redirect response itself instead of following it
+	MaxRedirects int               `yaml:"max_redirects"`
+	UserAgent    string            `yaml:"user_agent"`
+	Headers      map[string]string `yaml:"headers"`
+	// ProxyURL sends every download through this proxy, when empty the
+	// HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables are used
+	ProxyURL           string `yaml:"proxy_url"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+	// CABundle is a PEM file of extra certificate authorities to trust on
+	// top of the system pool
+	CABundle string `yaml:"ca_bundle"`
+}
+
+// NewHTTPClient builds the download client described by cfg. Unless guard is
+// nil, it only connects and follows redirects to where the guard allows.
+func NewHTTPClient(cfg ClientConfig, guard *Guard) (*http.Client, error) {
+	proxy := http.ProxyFromEnvironment
+	if cfg.ProxyURL != "" {
+		proxyURL, err := url.Parse(cfg.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("downloader: invalid proxy url %s: %w", cfg.ProxyURL, err)
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: cfg.InsecureSkipVerify}
+	if cfg.CABundle != "" {
+		pool, err := loadCABundle(cfg.CABundle)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   seconds(cfg.ConnectTimeoutSeconds, defaultConnectTimeout),
+		KeepAlive: 30 * time.Second,
+	}
+
+	dial := dialer.DialContext
+	if guard != nil {
+		dial = guard.dialContext(dial)
+		proxy = guard.proxy(proxy)
+	}
+
+	transport := &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           dial,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   seconds(cfg.TLSHandshakeTimeoutSeconds, defaultTLSHandshakeTimeout),
+		ResponseHeaderTimeout: seconds(cfg.ResponseHeaderTimeoutSeconds, defaultResponseHeaderTimeout),
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+
+	maxRedirects := cfg.MaxRedirects
+	if maxRedirects == 0 {
+		maxRedirects = defaultMaxRedirects
+	}
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   seconds(cfg.TimeoutSeconds, defaultTimeout),
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if maxRedirects < 0 {
+				return http.ErrUseLastResponse
+			}
+			if guard != nil {
+				if err := guard.checkTarget(req.URL); err != nil {
+					return err
+				}
+			}
+			if len(via) > maxRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxRedirects)
+			}
+			// Only hops that are followed are recorded
+			recordRedirect(req, via)
+			return nil
+		},
+	}, nil
+}
+
+// newRequest builds a download request carrying the configured user agent and
+// headers
+func newRequest(cfg ClientConfig, rawURL string) (*http.Request, error) {
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	userAgent := cfg.UserAgent
+	if userAgent == "" {
+		userAgent = defaultUserAgent
+	}
+	req.Header.Set("User-Agent", userAgent)
+	for name, value := range cfg.Headers {
+		req.Header.Set(name, value)
+	}
+
+	return req, nil
+}
+
+func loadCABundle(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("downloader: reading ca bundle: %w", err)
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("downloader: ca bundle contains no certificates")
+	}
+	return pool, nil
+}
+
+func seconds(value int, fallback time.Duration) time.Duration {
+	if value <= 0 {
+		return fallback
+	}
+	return time.Duration(value) * time.Second
+}
@@ -0,0 +1,88 @@
+package downloader
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"mime"
+	"strings"
+)
+
+// fingerprint hashes a body as it is read. The raw bytes are hashed with
+// SHA-256 and, for textual content, so is a normalized form of the text in
+// which runs of whitespace are collapsed and HTML or XML tags are dropped, so
+// a page whose markup or formatting changed but whose text did not can be
+// told apart from one whose text changed.
+type fingerprint struct {
+	raw  hash.Hash
+	text hash.Hash
+
+	markup  bool
+	inTag   bool
+	space   bool
+	started bool
+	buf     []byte
+}
+
+// newFingerprint returns a fingerprint for a body of the given content type.
+// Only text content types get a normalized text hash.
+func newFingerprint(contentType string) *fingerprint {
+	f := &fingerprint{raw: sha256.New()}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return f
+	}
+	switch {
+	case mediaType == "text/html", mediaType == "application/xhtml+xml",
+		mediaType == "text/xml", mediaType == "application/xml", strings.HasSuffix(mediaType, "+xml"):
+		f.text, f.markup = sha256.New(), true
+	case strings.HasPrefix(mediaType, "text/"), mediaType == "application/json",
+		strings.HasSuffix(mediaType, "+json"), mediaType == "application/javascript":
+		f.text = sha256.New()
+	}
+	return f
+}
+
+func (f *fingerprint) Write(p []byte) (int, error) {
+	f.raw.Write(p)
+	if f.text != nil {
+		f.normalize(p)
+	}
+	return len(p), nil
+}
+
+// normalize feeds the text hash with p minus tags and with every run of
+// whitespace turned into a single space. The state carries over between
+// writes so a tag or run split across two reads is handled the same.
+func (f *fingerprint) normalize(p []byte) {
+	f.buf = f.buf[:0]
+	for _, c := range p {
+		switch {
+		case f.markup && f.inTag:
+			f.inTag = c != '>'
+		case f.markup && c == '<':
+			// A tag separates words like whitespace does
+			f.inTag, f.space = true, true
+		case c == ' ', c == '\t', c == '\n', c == '\r', c == '\f', c == '\v':
+			f.space = true
+		default:
+			if f.space && f.started {
+				f.buf = append(f.buf, ' ')
+			}
+			f.space, f.started = false, true
+			f.buf = append(f.buf, c)
+		}
+	}
+	f.text.Write(f.buf)
+}
+
+// sums returns the hex encoded raw and normalized text hashes, the latter
+// empty for content that isn't text
+func (f *fingerprint) sums() (string, string) {
+	raw := hex.EncodeToString(f.raw.Sum(nil))
+	if f.text == nil {
+		return raw, ""
+	}
+	return raw, hex.EncodeToString(f.text.Sum(nil))
+}
@@ -0,0 +1,299 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// GuardConfig keeps the downloader away from internal addresses, so
+// submitting a URL can't be used to reach the daemon's own network. The zero
+// value leaves the guard off. Downloads sent through a proxy, the configured
+// one or one from the environment, have their host resolved and checked
+// before each request, as the address dialled is the proxy's.
+type GuardConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// AllowedSchemes defaults to http and https and AllowedPorts to 80 and
+	// 443
+	AllowedSchemes []string `yaml:"allowed_schemes"`
+	AllowedPorts   []int    `yaml:"allowed_ports"`
+	// BlockedCIDRs are refused on top of the loopback, link-local, private
+	// and other special purpose ranges, which always are
+	BlockedCIDRs []string `yaml:"blocked_cidrs"`
+	// AllowedHosts and AllowedCIDRs are let through whatever range they are
+	// in. A host starting with a dot allows every subdomain of it.
+	AllowedHosts []string `yaml:"allowed_hosts"`
+	AllowedCIDRs []string `yaml:"allowed_cidrs"`
+}
+
+// specialRanges are special purpose ranges not covered by the netip.Addr
+// predicates checked in addrAllowed
+var specialRanges = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	// Deprecated IPv6 site-local and local-use NAT64, which only ever lead
+	// into a private network
+	netip.MustParsePrefix("fec0::/10"),
+	netip.MustParsePrefix("64:ff9b:1::/48"),
+}
+
+// nat64 and sixToFour are IPv6 ranges that carry an IPv4 address, which is
+// the one that ends up being reached
+var (
+	nat64     = netip.MustParsePrefix("64:ff9b::/96")
+	sixToFour = netip.MustParsePrefix("2002::/16")
+)
+
+// forbiddenError is why the guard refused a URL or an address
+type forbiddenError struct {
+	reason string
+}
+
+func (e *forbiddenError) Error() string {
+	return "forbidden by ssrf guard: " + e.reason
+}
+
+func forbidden(format string, args ...any) error {
+	return &forbiddenError{fmt.Sprintf(format, args...)}
+}
+
+// Guard checks URLs when they are submitted and redirected to and, as the
+// final say, the addresses the client dials. Dialling the addresses it
+// checked, rather than resolving the host again, stops a host from passing
+// the check and then resolving to an internal address.
+type Guard struct {
+	schemes      []string
+	ports        []int
+	blocked      []netip.Prefix
+	allowed      []netip.Prefix
+	allowedHosts []string
+	resolver     *net.Resolver
+}
+
+// NewGuard builds the guard described by cfg, nil if it is disabled
+func NewGuard(cfg GuardConfig) (*Guard, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	g := &Guard{
+		schemes:  cfg.AllowedSchemes,
+		ports:    cfg.AllowedPorts,
+		blocked:  slices.Clone(specialRanges),
+		resolver: net.DefaultResolver,
+	}
+	if len(g.schemes) == 0 {
+		g.schemes = []string{"http", "https"}
+	}
+	if len(g.ports) == 0 {
+		g.ports = []int{80, 443}
+	}
+	for _, host := range cfg.AllowedHosts {
+		g.allowedHosts = append(g.allowedHosts, strings.ToLower(host))
+	}
+
+	var err error
+	if g.blocked, err = appendPrefixes(g.blocked, cfg.BlockedCIDRs); err != nil {
+		return nil, err
+	}
+	if g.allowed, err = appendPrefixes(nil, cfg.AllowedCIDRs); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+func appendPrefixes(prefixes []netip.Prefix, cidrs []string) ([]netip.Prefix, error) {
+	for _, cidr := range cidrs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("downloader: invalid ssrf guard cidr %s: %w", cidr, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// CheckURL reports why the URL may not be downloaded, resolving its host to
+// check every address it has. A host that doesn't resolve is let through as
+// its download will fail anyway.
+func (g *Guard) CheckURL(ctx context.Context, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if err := g.checkTarget(u); err != nil {
+		return err
+	}
+
+	host := u.Hostname()
+	if g.hostAllowed(host) {
+		return nil
+	}
+	addrs, err := g.resolve(ctx, host)
+	if err != nil {
+		return nil
+	}
+	return g.checkAddrs(host, addrs)
+}
+
+// checkTarget checks the scheme and port of a URL and, if its host is an IP
+// address, the address. It doesn't resolve the host, the dial check covers
+// that for redirects.
+func (g *Guard) checkTarget(u *url.URL) error {
+	scheme := strings.ToLower(u.Scheme)
+	if !slices.Contains(g.schemes, scheme) {
+		return forbidden("scheme %s is not allowed", u.Scheme)
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = map[string]string{"http": "80", "https": "443"}[scheme]
+	}
+	if n, err := strconv.Atoi(port); err != nil || !slices.Contains(g.ports, n) {
+		return forbidden("port %s is not allowed", port)
+	}
+
+	host := u.Hostname()
+	if addr, err := netip.ParseAddr(host); err == nil && !g.hostAllowed(host) {
+		return g.checkAddrs(host, []netip.Addr{addr})
+	}
+	return nil
+}
+
+// hostAllowed reports whether the host is on the allowlist
+func (g *Guard) hostAllowed(host string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for _, allowed := range g.allowedHosts {
+		if host == allowed || (strings.HasPrefix(allowed, ".") && strings.HasSuffix(host, allowed)) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve returns the addresses of a host, which may be an IP address itself
+func (g *Guard) resolve(ctx context.Context, host string) ([]netip.Addr, error) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{addr}, nil
+	}
+	return g.resolver.LookupNetIP(ctx, "ip", host)
+}
+
+// checkAddrs refuses the host if any of its addresses is refused
+func (g *Guard) checkAddrs(host string, addrs []netip.Addr) error {
+	for _, addr := range addrs {
+		switch {
+		case g.addrAllowed(addr):
+		case host == addr.String():
+			return forbidden("%s is in a blocked range", addr)
+		default:
+			return forbidden("%s resolves to %s in a blocked range", host, addr)
+		}
+	}
+	return nil
+}
+
+func (g *Guard) addrAllowed(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range g.allowed {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	if embedded, ok := embeddedIPv4(addr); ok {
+		return g.addrAllowed(embedded)
+	}
+
+	if addr.IsLoopback() || addr.IsPrivate() || addr.IsUnspecified() || addr.IsLinkLocalUnicast() ||
+		addr.IsLinkLocalMulticast() || addr.IsInterfaceLocalMulticast() || addr.IsMulticast() {
+		return false
+	}
+	for _, prefix := range g.blocked {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// embeddedIPv4 returns the IPv4 address a NAT64 or 6to4 address leads to
+func embeddedIPv4(addr netip.Addr) (netip.Addr, bool) {
+	b := addr.As16()
+	switch {
+	case nat64.Contains(addr):
+		return netip.AddrFrom4([4]byte(b[12:16])), true
+	case sixToFour.Contains(addr):
+		return netip.AddrFrom4([4]byte(b[2:6])), true
+	}
+	return netip.Addr{}, false
+}
+
+// dialContext wraps dial so it only connects to addresses the guard allows.
+// With a proxy the address dialled is the proxy's, so an internal proxy has
+// to be allowlisted, and the target is checked by proxy instead.
+func (g *Guard) dialContext(dial func(ctx context.Context, network, address string) (net.Conn, error)) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		if g.hostAllowed(host) {
+			return dial(ctx, network, address)
+		}
+
+		addrs, err := g.resolve(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		if err := g.checkAddrs(host, addrs); err != nil {
+			return nil, err
+		}
+
+		var errs []error
+		for _, addr := range addrs {
+			conn, err := dial(ctx, network, net.JoinHostPort(addr.String(), port))
+			if err == nil {
+				return conn, nil
+			}
+			errs = append(errs, err)
+		}
+		return nil, errors.Join(errs...)
+	}
+}
+
+// proxy wraps a transport's proxy func so a request sent through a proxy is
+// only made if the guard allows every address its host resolves to. The proxy
+// resolves the host again, so unlike a direct download this can't stop a
+// host from changing its addresses between the check and the request.
+func (g *Guard) proxy(proxy func(*http.Request) (*url.URL, error)) func(*http.Request) (*url.URL, error) {
+	return func(req *http.Request) (*url.URL, error) {
+		proxyURL, err := proxy(req)
+		if err != nil || proxyURL == nil {
+			return proxyURL, err
+		}
+
+		host := req.URL.Hostname()
+		if g.hostAllowed(host) {
+			return proxyURL, nil
+		}
+		addrs, err := g.resolve(req.Context(), host)
+		if err != nil {
+			return nil, err
+		}
+		if err := g.checkAddrs(host, addrs); err != nil {
+			return nil, err
+		}
+		return proxyURL, nil
+	}
+}
@@ -0,0 +1,163 @@
+package downloader
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// Job statuses, a job moves from queued to running to one of the finished
+// statuses
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+	// JobDiscarded means the download failed and, as it was the first
+	// download of the URL, the URL wasn't stored but rejected
+	JobDiscarded = "discarded"
+	// JobBlocked means robots.txt disallows the URL so it wasn't downloaded
+	JobBlocked = "blocked"
+	// JobAborted means the download went over one of the body limits
+	JobAborted = "aborted"
+)
+
+const (
+	defaultMaxFinishedJobs = 10000
+	defaultJobRetention    = time.Hour
+)
+
+// Job tracks the download triggered by a single submission
+type Job struct {
+	ID         string     `json:"id"`
+	URL        string     `json:"url"`
+	Status     string     `json:"status"`
+	StatusCode int        `json:"status_code,omitempty"`
+	Attempts   int        `json:"attempts,omitempty"`
+	DurationMs int64      `json:"duration_ms,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// Jobs holds every pending job and a bounded number of finished ones.
+// Finished jobs are forgotten once there are more than maxFinished of them
+// or they are older than retention.
+type Jobs struct {
+	mu          sync.Mutex
+	jobs        map[string]*Job
+	finished    []string
+	maxFinished int
+	retention   time.Duration
+}
+
+func NewJobs(maxFinished int, retention time.Duration) *Jobs {
+	if maxFinished <= 0 {
+		maxFinished = defaultMaxFinishedJobs
+	}
+	if retention <= 0 {
+		retention = defaultJobRetention
+	}
+
+	return &Jobs{
+		jobs:        make(map[string]*Job),
+		maxFinished: maxFinished,
+		retention:   retention,
+	}
+}
+
+func (j *Jobs) create(url string) Job {
+	job := &Job{
+		ID:        newJobID(),
+		URL:       url,
+		Status:    JobQueued,
+		CreatedAt: time.Now(),
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.jobs[job.ID] = job
+	return *job
+}
+
+// remove forgets a job that never made it onto the queue
+func (j *Jobs) remove(id string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	delete(j.jobs, id)
+}
+
+func (j *Jobs) start(id string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if job, ok := j.jobs[id]; ok {
+		now := time.Now()
+		job.Status = JobRunning
+		job.StartedAt = &now
+		job.Attempts = 1
+	}
+}
+
+// retry records that the job's download is being tried again
+func (j *Jobs) retry(id string, try int) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if job, ok := j.jobs[id]; ok {
+		job.Attempts = try
+	}
+}
+
+func (j *Jobs) finish(id, status string, statusCode int, durationMs int64, errMsg string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	job, ok := j.jobs[id]
+	if !ok {
+		return
+	}
+	job.Status = status
+	job.StatusCode = statusCode
+	job.DurationMs = durationMs
+	job.Error = errMsg
+	now := time.Now()
+	job.FinishedAt = &now
+
+	j.finished = append(j.finished, id)
+	j.prune(now)
+}
+
+// prune drops finished jobs, oldest first, that are past their retention or
+// over the limit. Must be called with the lock held.
+func (j *Jobs) prune(now time.Time) {
+	drop := 0
+	for drop < len(j.finished) {
+		oldest := j.jobs[j.finished[drop]]
+		if len(j.finished)-drop <= j.maxFinished && now.Sub(*oldest.FinishedAt) <= j.retention {
+			break
+		}
+		delete(j.jobs, oldest.ID)
+		drop++
+	}
+	j.finished = j.finished[drop:]
+}
+
+// Get returns a copy of the job with the given ID
+func (j *Jobs) Get(id string) (Job, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.prune(time.Now())
+	job, ok := j.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return *job, true
+}
+
+func newJobID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,338 @@
+package downloader
+
+import (
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LimitConfig caps the downloads from a single host or domain. Zero values
+// leave the limit off.
+type LimitConfig struct {
+	MaxConcurrent     int     `yaml:"max_concurrent"`
+	RequestsPerSecond float64 `yaml:"requests_per_second"`
+	// Burst is how many requests can start back to back after a quiet
+	// period before RequestsPerSecond kicks in. Defaults to 1.
+	Burst int `yaml:"burst"`
+}
+
+// PolitenessConfig stops the downloader from hammering a single site. Every
+// host is limited by PerHost and, on top of that, all hosts under the same
+// registered domain, such as a.example.com and b.example.com, share PerDomain.
+type PolitenessConfig struct {
+	PerHost   LimitConfig `yaml:"per_host"`
+	PerDomain LimitConfig `yaml:"per_domain"`
+}
+
+// bucket tracks the running downloads and request tokens of one host or
+// domain
+type bucket struct {
+	active int
+	tokens float64
+	last   time.Time
+	// started is when the latest download began, or is booked to begin, and
+	// with a crawl delay decides when the next one may
+	started time.Time
+}
+
+// limiter applies one LimitConfig to many hosts or domains
+type limiter struct {
+	config  LimitConfig
+	buckets map[string]*bucket
+}
+
+func newLimiter(cfg LimitConfig) limiter {
+	if cfg.Burst <= 0 {
+		cfg.Burst = 1
+	}
+	return limiter{config: cfg, buckets: make(map[string]*bucket)}
+}
+
+// bucket returns the key's bucket with its tokens refilled up to now
+func (l *limiter) bucket(key string, now time.Time) *bucket {
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(l.config.Burst), last: now}
+		l.buckets[key] = b
+	}
+
+	if l.config.RequestsPerSecond > 0 && now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * l.config.RequestsPerSecond
+		if b.tokens > float64(l.config.Burst) {
+			b.tokens = float64(l.config.Burst)
+		}
+	}
+	b.last = now
+	return b
+}
+
+// idle reports whether a bucket is back to its starting state and can be
+// forgotten
+func (l *limiter) idle(b *bucket, now time.Time, delay time.Duration) bool {
+	return b.active == 0 && b.tokens >= float64(l.config.Burst) && !now.Before(b.started.Add(delay))
+}
+
+// wait returns how long until a download of key may start, false if it is
+// held back by the concurrency cap and has to wait for a running one to end.
+// delay is the least time between the starts of two downloads.
+func (l *limiter) wait(key string, now time.Time, rateLimited bool, delay time.Duration) (time.Duration, bool) {
+	b := l.bucket(key, now)
+	if l.config.MaxConcurrent > 0 && b.active >= l.config.MaxConcurrent {
+		return 0, false
+	}
+	if !rateLimited {
+		return 0, true
+	}
+
+	var wait time.Duration
+	if l.config.RequestsPerSecond > 0 && b.tokens < 1 {
+		wait = tokenWait(b.tokens, l.config.RequestsPerSecond)
+	}
+	return max(wait, b.started.Add(delay).Sub(now)), true
+}
+
+// take uses up a token of key and books the next start after delay. It
+// returns how long until the download would have been allowed to start, for
+// callers that go ahead regardless.
+func (l *limiter) take(key string, now time.Time, delay time.Duration) time.Duration {
+	b := l.bucket(key, now)
+	start := now
+	if next := b.started.Add(delay); next.After(now) {
+		start = next
+	}
+	b.started = start
+	wait := start.Sub(now)
+
+	if l.config.RequestsPerSecond <= 0 {
+		return wait
+	}
+	b.tokens--
+	if b.tokens >= 0 {
+		return wait
+	}
+	return max(wait, tokenWait(b.tokens+1, l.config.RequestsPerSecond))
+}
+
+func tokenWait(tokens, rate float64) time.Duration {
+	return time.Duration((1 - tokens) / rate * float64(time.Second))
+}
+
+// hostLimits holds the per host and per domain limiters. The dispatcher
+// starts downloads through it and workers take tokens for their retries, so
+// it is guarded by a mutex.
+type hostLimits struct {
+	mu     sync.Mutex
+	host   limiter
+	domain limiter
+	// crawlDelays are the robots.txt crawl delays of hosts that have one
+	crawlDelays map[string]time.Duration
+}
+
+func newHostLimits(cfg PolitenessConfig) *hostLimits {
+	return &hostLimits{
+		host:        newLimiter(cfg.PerHost),
+		domain:      newLimiter(cfg.PerDomain),
+		crawlDelays: make(map[string]time.Duration),
+	}
+}
+
+// setCrawlDelay spaces out the starts of downloads from host by at least
+// delay, zero removes the delay
+func (h *hostLimits) setCrawlDelay(host string, delay time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if delay <= 0 {
+		delete(h.crawlDelays, host)
+		return
+	}
+	h.crawlDelays[host] = delay
+}
+
+// wait returns how long until the task may start, false if it has to wait
+// for a running download of its host or domain to end. Rate limits are
+// ignored unless rateLimited is set.
+func (h *hostLimits) wait(t task, now time.Time, rateLimited bool) (time.Duration, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	hostWait, ok := h.host.wait(t.host, now, rateLimited, h.crawlDelays[t.host])
+	if !ok {
+		return 0, false
+	}
+	domainWait, ok := h.domain.wait(t.domain, now, rateLimited, 0)
+	if !ok {
+		return 0, false
+	}
+	return max(hostWait, domainWait), true
+}
+
+// start counts the task as running and uses up its request tokens
+func (h *hostLimits) start(t task, now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.host.take(t.host, now, h.crawlDelays[t.host])
+	h.domain.take(t.domain, now, 0)
+	h.host.buckets[t.host].active++
+	h.domain.buckets[t.domain].active++
+}
+
+// reserve takes request tokens for a retry of a running task and returns how
+// long to wait before making it
+func (h *hostLimits) reserve(t task, now time.Time) time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return max(h.host.take(t.host, now, h.crawlDelays[t.host]), h.domain.take(t.domain, now, 0))
+}
+
+// finish counts the task as no longer running
+func (h *hostLimits) finish(t task, now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, level := range []struct {
+		limiter *limiter
+		key     string
+		delay   time.Duration
+	}{{&h.host, t.host, h.crawlDelays[t.host]}, {&h.domain, t.domain, 0}} {
+		b := level.limiter.bucket(level.key, now)
+		b.active--
+		if level.limiter.idle(b, now, level.delay) {
+			delete(level.limiter.buckets, level.key)
+		}
+	}
+}
+
+// prune forgets hosts and domains that have been quiet long enough for
+// their buckets to refill
+func (h *hostLimits) prune(now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for key := range h.host.buckets {
+		if h.host.idle(h.host.bucket(key, now), now, h.crawlDelays[key]) {
+			delete(h.host.buckets, key)
+		}
+	}
+	for key := range h.domain.buckets {
+		if h.domain.idle(h.domain.bucket(key, now), now, 0) {
+			delete(h.domain.buckets, key)
+		}
+	}
+}
+
+// waitQueue holds the tasks that haven't been handed to a worker yet,
+// grouped by host so a host at its limit doesn't hold up the others. Hosts
+// are kept in the order of their oldest task.
+type waitQueue struct {
+	tasks map[string][]task
+	hosts []string
+	size  int
+	// held are the hosts whose robots.txt is being fetched, none of their
+	// tasks start until it is in
+	held map[string]bool
+}
+
+func newWaitQueue() *waitQueue {
+	return &waitQueue{tasks: make(map[string][]task), held: make(map[string]bool)}
+}
+
+func (q *waitQueue) hold(host string) {
+	q.held[host] = true
+}
+
+func (q *waitQueue) release(host string) {
+	delete(q.held, host)
+}
+
+func (q *waitQueue) push(t task) {
+	if len(q.tasks[t.host]) == 0 {
+		q.hosts = append(q.hosts, t.host)
+	}
+	q.tasks[t.host] = append(q.tasks[t.host], t)
+	q.size++
+}
+
+// next returns the oldest task that may start now. If there is none it
+// returns how long until one held back by a rate limit may start, zero if
+// every host is waiting on a running download or its robots.txt.
+func (q *waitQueue) next(limits *hostLimits, now time.Time, rateLimited bool) (task, time.Duration, bool) {
+	var soonest time.Duration
+	for _, host := range q.hosts {
+		if q.held[host] {
+			continue
+		}
+		t := q.tasks[host][0]
+		wait, ok := limits.wait(t, now, rateLimited)
+		if !ok {
+			continue
+		}
+		if wait == 0 {
+			return t, 0, true
+		}
+		if soonest == 0 || wait < soonest {
+			soonest = wait
+		}
+	}
+	return task{}, soonest, false
+}
+
+// remove drops the oldest task of host, the one next returned
+func (q *waitQueue) remove(host string) {
+	q.tasks[host] = q.tasks[host][1:]
+	q.size--
+	if len(q.tasks[host]) > 0 {
+		return
+	}
+
+	delete(q.tasks, host)
+	for i, h := range q.hosts {
+		if h == host {
+			q.hosts = append(q.hosts[:i], q.hosts[i+1:]...)
+			break
+		}
+	}
+}
+
+// hostKeys returns the lower cased host name of the URL and its registered
+// domain
+func hostKeys(rawURL string) (string, string) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return "", ""
+	}
+	host := strings.ToLower(parsed.Hostname())
+	return host, registeredDomain(host)
+}
+
+// secondLevelLabels are second level labels commonly used below country code
+// TLDs, such as co.uk or com.au, where the registered domain has three
+// labels. This is a heuristic rather than the full public suffix list.
+var secondLevelLabels = map[string]bool{
+	"ac": true, "co": true, "com": true, "edu": true, "gov": true,
+	"net": true, "org": true, "ne": true, "or": true, "go": true,
+}
+
+// registeredDomain returns the domain a host was registered under, for
+// example example.co.uk for www.example.co.uk. IP addresses are returned
+// as they are.
+func registeredDomain(host string) string {
+	host = strings.TrimSuffix(host, ".")
+	if net.ParseIP(host) != nil {
+		return host
+	}
+
+	labels := strings.Split(host, ".")
+	n := 2
+	if len(labels) > 2 && len(labels[len(labels)-1]) == 2 && secondLevelLabels[labels[len(labels)-2]] {
+		n = 3
+	}
+	if len(labels) <= n {
+		return host
+	}
+	return strings.Join(labels[len(labels)-n:], ".")
+}
@@ -0,0 +1,54 @@
+package downloader
+
+import (
+	"context"
+	"net/http"
+	"spamhaus/store"
+	"strings"
+	"time"
+)
+
+type redirectsKey struct{}
+
+// redirectRecorder collects the hops of a download as the client follows
+// its redirects. CheckRedirect runs on the goroutine making the request, so
+// it needs no locking.
+type redirectRecorder struct {
+	hops     []store.Redirect
+	hopStart time.Time
+}
+
+// withRedirectRecorder returns a context that makes the client record the
+// redirects of a request made with it
+func withRedirectRecorder(ctx context.Context, start time.Time) (context.Context, *redirectRecorder) {
+	recorder := &redirectRecorder{hopStart: start}
+	return context.WithValue(ctx, redirectsKey{}, recorder), recorder
+}
+
+// recordRedirect adds the hop that led to req to the recorder in its
+// context, if there is one. via[len(via)-1] is the request that was
+// redirected and req.Response the redirect it got.
+func recordRedirect(req *http.Request, via []*http.Request) {
+	recorder, ok := req.Context().Value(redirectsKey{}).(*redirectRecorder)
+	if !ok || len(via) == 0 {
+		return
+	}
+
+	now := time.Now()
+	from := via[len(via)-1].URL
+	hop := store.Redirect{
+		URL:        from.String(),
+		Location:   req.URL.String(),
+		DurationMs: now.Sub(recorder.hopStart).Milliseconds(),
+		Downgrade:  from.Scheme == "https" && req.URL.Scheme == "http",
+	}
+	if req.Response != nil {
+		hop.StatusCode = req.Response.StatusCode
+	}
+	fromDomain := registeredDomain(strings.ToLower(from.Hostname()))
+	toDomain := registeredDomain(strings.ToLower(req.URL.Hostname()))
+	hop.CrossDomain = fromDomain != toDomain
+
+	recorder.hops = append(recorder.hops, hop)
+	recorder.hopStart = now
+}
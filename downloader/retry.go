@@ -0,0 +1,132 @@
+package downloader
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryConfig decides whether a failed download is tried again and how long
+// the worker waits first. MaxAttempts of 0 or 1 disables retries.
+type RetryConfig struct {
+	MaxAttempts   int `yaml:"max_attempts"`
+	BaseBackoffMs int `yaml:"base_backoff_ms"`
+	MaxBackoffMs  int `yaml:"max_backoff_ms"`
+	// Jitter randomly shortens each backoff by up to this fraction, 0 to 1,
+	// so retries of URLs that failed together are spread out
+	Jitter               float64 `yaml:"jitter"`
+	RetryableStatusCodes []int   `yaml:"retryable_status_codes"`
+	RetryOnTimeout       bool    `yaml:"retry_on_timeout"`
+	// RetryOnConnectionError retries refused, reset and dropped connections
+	// and temporary DNS failures, but not unknown hosts
+	RetryOnConnectionError bool `yaml:"retry_on_connection_error"`
+	// RespectRetryAfter waits as long as a 429 or 503 response's Retry-After
+	// header asks. If that is longer than MaxBackoffMs the URL isn't retried.
+	RespectRetryAfter bool `yaml:"respect_retry_after"`
+}
+
+// shouldRetry reports whether another attempt should follow this one. err is
+// set when the request or reading the body failed, resp is nil when there was
+// no response at all.
+func (c RetryConfig) shouldRetry(try int, resp *http.Response, err error) bool {
+	if try >= c.MaxAttempts {
+		return false
+	}
+
+	switch {
+	case err == nil:
+	case isTimeout(err):
+		return c.RetryOnTimeout
+	case isConnectionError(err):
+		return c.RetryOnConnectionError
+	default:
+		return false
+	}
+
+	if resp == nil {
+		return false
+	}
+	for _, code := range c.RetryableStatusCodes {
+		if resp.StatusCode == code {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff returns how long to wait before attempt try+1, or false if the
+// server asked for a longer wait than the policy allows
+func (c RetryConfig) backoff(try int, resp *http.Response) (time.Duration, bool) {
+	maxBackoff := time.Duration(c.MaxBackoffMs) * time.Millisecond
+
+	if c.RespectRetryAfter && resp != nil {
+		if wait, ok := retryAfter(resp); ok {
+			if maxBackoff > 0 && wait > maxBackoff {
+				return 0, false
+			}
+			return wait, true
+		}
+	}
+
+	delay := time.Duration(float64(c.BaseBackoffMs)*math.Pow(2, float64(try-1))) * time.Millisecond
+	if maxBackoff > 0 && delay > maxBackoff {
+		delay = maxBackoff
+	}
+	if c.Jitter > 0 {
+		delay -= time.Duration(rand.Float64() * math.Min(c.Jitter, 1) * float64(delay))
+	}
+	return delay, true
+}
+
+// retryAfter parses the Retry-After header of a 429 or 503 response, given
+// either in seconds or as an HTTP date
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return 0, false
+	}
+
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(value); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return max(time.Until(at), 0), true
+	}
+	return 0, false
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout())
+}
+
+// isConnectionError reports whether the connection to the server was lost or
+// never made for a reason that may go away. Certificate problems, TLS alerts
+// and unknown hosts won't, so they don't count.
+func isConnectionError(err error) bool {
+	var certErr *tls.CertificateVerificationError
+	if errors.As(err, &certErr) {
+		return false
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return !dnsErr.IsNotFound
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return opErr.Op != "remote error"
+	}
+	return errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF)
+}
@@ -0,0 +1,330 @@
+package downloader
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRobotsTTL     = 24 * time.Hour
+	defaultMaxCrawlDelay = 30 * time.Second
+	robotsUnreachableTTL = 5 * time.Minute
+	robotsSweepInterval  = time.Minute
+	maxRobotsBytes       = 512 * 1024
+)
+
+// RobotsConfig turns on checking every URL against its site's robots.txt
+// before downloading it
+type RobotsConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// UserAgent is the name matched against User-agent lines, it defaults
+	// to the client's user agent up to the first slash
+	UserAgent       string `yaml:"user_agent"`
+	CacheTTLSeconds int    `yaml:"cache_ttl_seconds"`
+	// MaxCrawlDelaySeconds caps the Crawl-delay a site can ask for
+	MaxCrawlDelaySeconds int `yaml:"max_crawl_delay_seconds"`
+}
+
+// robotsRule is a single Allow or Disallow line
+type robotsRule struct {
+	allow   bool
+	pattern string
+}
+
+// robotsRules are the rules of the robots.txt groups that apply to us
+type robotsRules struct {
+	rules      []robotsRule
+	crawlDelay time.Duration
+	// disallowAll is set when robots.txt could not be fetched because the
+	// server is failing, which is taken to mean nothing may be crawled
+	disallowAll bool
+}
+
+// allowed reports whether the path, including any query, may be downloaded.
+// The longest matching rule wins and Allow wins a tie.
+func (r robotsRules) allowed(path string) bool {
+	if path == "/robots.txt" {
+		return true
+	}
+	if r.disallowAll {
+		return false
+	}
+
+	allow, longest := true, -1
+	for _, rule := range r.rules {
+		if len(rule.pattern) < longest || !matchRobotsPattern(rule.pattern, path) {
+			continue
+		}
+		if len(rule.pattern) > longest || rule.allow {
+			allow = rule.allow
+		}
+		longest = len(rule.pattern)
+	}
+	return allow
+}
+
+// matchRobotsPattern matches a path against a rule pattern, where * matches
+// any run of characters and a trailing $ anchors the end of the path
+func matchRobotsPattern(pattern, path string) bool {
+	anchored := strings.HasSuffix(pattern, "$")
+	pattern = strings.TrimSuffix(pattern, "$")
+
+	parts := strings.Split(pattern, "*")
+	if !strings.HasPrefix(path, parts[0]) {
+		return false
+	}
+	pos := len(parts[0])
+
+	for i, part := range parts[1:] {
+		if anchored && i == len(parts)-2 {
+			return len(path)-len(part) >= pos && strings.HasSuffix(path, part)
+		}
+		index := strings.Index(path[pos:], part)
+		if index < 0 {
+			return false
+		}
+		pos += index + len(part)
+	}
+	return !anchored || pos == len(path)
+}
+
+// robotsGroup is a run of User-agent lines and the rules that follow them
+type robotsGroup struct {
+	agents     []string
+	rules      []robotsRule
+	crawlDelay time.Duration
+}
+
+// parseRobots reads a robots.txt and returns the rules for agent. Every group
+// naming agent is merged, and only if there is none are the * groups used.
+func parseRobots(body []byte, agent string) robotsRules {
+	var groups []*robotsGroup
+	var current *robotsGroup
+	inAgents := false
+
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		key, value = strings.ToLower(strings.TrimSpace(key)), strings.TrimSpace(value)
+
+		if key == "user-agent" {
+			if !inAgents {
+				current = &robotsGroup{}
+				groups = append(groups, current)
+				inAgents = true
+			}
+			current.agents = append(current.agents, strings.ToLower(value))
+			continue
+		}
+
+		inAgents = false
+		if current == nil {
+			continue
+		}
+		switch key {
+		case "allow", "disallow":
+			// An empty Disallow allows everything, so it adds nothing
+			if value != "" {
+				current.rules = append(current.rules, robotsRule{allow: key == "allow", pattern: value})
+			}
+		case "crawl-delay":
+			if secs, err := strconv.ParseFloat(value, 64); err == nil && secs > 0 {
+				current.crawlDelay = time.Duration(secs * float64(time.Second))
+			}
+		}
+	}
+
+	agent = strings.ToLower(agent)
+	var rules, fallback robotsRules
+	matched := false
+	for _, group := range groups {
+		switch {
+		case group.names(agent):
+			rules.merge(group)
+			matched = true
+		case group.names("*"):
+			fallback.merge(group)
+		}
+	}
+
+	if !matched {
+		return fallback
+	}
+	return rules
+}
+
+func (g *robotsGroup) names(agent string) bool {
+	for _, name := range g.agents {
+		if name == agent {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *robotsRules) merge(group *robotsGroup) {
+	r.rules = append(r.rules, group.rules...)
+	r.crawlDelay = max(r.crawlDelay, group.crawlDelay)
+}
+
+// robotsEntry is the cached robots.txt of one site, ready is closed once it
+// has been fetched so concurrent downloads from the site wait for one fetch
+type robotsEntry struct {
+	ready   chan struct{}
+	rules   robotsRules
+	expires time.Time
+}
+
+// robotsCache fetches and caches robots.txt per scheme and host
+type robotsCache struct {
+	mu        sync.Mutex
+	entries   map[string]*robotsEntry
+	lastSweep time.Time
+
+	client        *http.Client
+	clientConfig  ClientConfig
+	agent         string
+	ttl           time.Duration
+	maxCrawlDelay time.Duration
+}
+
+func newRobotsCache(cfg RobotsConfig, client *http.Client, clientConfig ClientConfig) *robotsCache {
+	agent := cfg.UserAgent
+	if agent == "" {
+		agent = clientConfig.UserAgent
+		if agent == "" {
+			agent = defaultUserAgent
+		}
+		agent, _, _ = strings.Cut(agent, "/")
+	}
+
+	return &robotsCache{
+		entries:       make(map[string]*robotsEntry),
+		client:        client,
+		clientConfig:  clientConfig,
+		agent:         agent,
+		ttl:           seconds(cfg.CacheTTLSeconds, defaultRobotsTTL),
+		maxCrawlDelay: seconds(cfg.MaxCrawlDelaySeconds, defaultMaxCrawlDelay),
+	}
+}
+
+func robotsSite(u *url.URL) string {
+	return strings.ToLower(u.Scheme + "://" + u.Host)
+}
+
+// cached returns the robots.txt rules for the URL's site without fetching
+// them, false if they haven't been fetched yet or have expired
+func (c *robotsCache) cached(u *url.URL) (robotsRules, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[robotsSite(u)]
+	if !ok {
+		return robotsRules{}, false
+	}
+	select {
+	case <-entry.ready:
+		return entry.rules, time.Now().Before(entry.expires)
+	default:
+		return robotsRules{}, false
+	}
+}
+
+// rules returns the robots.txt rules for the URL's site, fetching them if
+// they aren't cached
+func (c *robotsCache) rules(u *url.URL) robotsRules {
+	site := robotsSite(u)
+	now := time.Now()
+
+	c.mu.Lock()
+	entry, ok := c.entries[site]
+	if ok {
+		select {
+		case <-entry.ready:
+			ok = now.Before(entry.expires)
+		default:
+		}
+	}
+	if !ok {
+		c.sweep(now)
+		entry = &robotsEntry{ready: make(chan struct{})}
+		c.entries[site] = entry
+		c.mu.Unlock()
+
+		entry.rules, entry.expires = c.fetch(site)
+		close(entry.ready)
+		return entry.rules
+	}
+	c.mu.Unlock()
+
+	<-entry.ready
+	return entry.rules
+}
+
+// sweep forgets expired entries, at most once a minute. Must be called with
+// the lock held.
+func (c *robotsCache) sweep(now time.Time) {
+	if now.Sub(c.lastSweep) < robotsSweepInterval {
+		return
+	}
+	c.lastSweep = now
+
+	for site, entry := range c.entries {
+		select {
+		case <-entry.ready:
+			if !now.Before(entry.expires) {
+				delete(c.entries, site)
+			}
+		default:
+		}
+	}
+}
+
+// fetch downloads and parses a site's robots.txt. A missing robots.txt
+// allows everything and so does a site that can't be reached, leaving the
+// download itself to fail. A server error disallows everything. Either of
+// the last two is only cached for a few minutes.
+func (c *robotsCache) fetch(site string) (robotsRules, time.Time) {
+	req, err := newRequest(c.clientConfig, site+"/robots.txt")
+	if err != nil {
+		return robotsRules{}, time.Now().Add(robotsUnreachableTTL)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		log.Printf("robots: fetching robots.txt of %s, %v", site, err)
+		return robotsRules{}, time.Now().Add(robotsUnreachableTTL)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		return robotsRules{}, time.Now().Add(c.ttl)
+	default:
+		log.Printf("robots: unexpected status %s for robots.txt of %s, disallowing it for now", resp.Status, site)
+		return robotsRules{disallowAll: true}, time.Now().Add(robotsUnreachableTTL)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxRobotsBytes))
+	if err != nil {
+		log.Printf("robots: reading robots.txt of %s, %v", site, err)
+		return robotsRules{}, time.Now().Add(robotsUnreachableTTL)
+	}
+
+	rules := parseRobots(body, c.agent)
+	rules.crawlDelay = min(rules.crawlDelay, c.maxCrawlDelay)
+	return rules, time.Now().Add(c.ttl)
+}
@@ -0,0 +1,112 @@
+package downloader
+
+import (
+	"crypto/tls"
+	"net/http/httptrace"
+	"spamhaus/store"
+	"sync"
+	"time"
+)
+
+// timer follows a download through httptrace, adding up the time spent in
+// each phase. Dials may run in parallel on other goroutines, hence the lock.
+type timer struct {
+	mu    sync.Mutex
+	start time.Time
+
+	dnsStart     time.Time
+	connectStart time.Time
+	tlsStart     time.Time
+	wrote        time.Time
+	firstByte    time.Time
+
+	dns, connect, tls, ttfb time.Duration
+}
+
+func newTimer(start time.Time) *timer {
+	return &timer{start: start}
+}
+
+// trace returns the hooks that feed the timer
+func (t *timer) trace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.dnsStart = time.Now()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.dns += since(&t.dnsStart)
+		},
+		ConnectStart: func(string, string) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			// With several addresses dialled at once the phase runs from the
+			// first dial starting to the first one connecting
+			if t.connectStart.IsZero() {
+				t.connectStart = time.Now()
+			}
+		},
+		ConnectDone: func(_, _ string, err error) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			if err == nil {
+				t.connect += since(&t.connectStart)
+			}
+		},
+		TLSHandshakeStart: func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.tlsStart = time.Now()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.tls += since(&t.tlsStart)
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.wrote = time.Now()
+		},
+		GotFirstResponseByte: func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.firstByte = time.Now()
+			t.ttfb += since(&t.wrote)
+		},
+	}
+}
+
+// finish returns the timing of a download that ended at end. The transfer
+// phase is the body of the last response, redirects included in ttfb.
+func (t *timer) finish(end time.Time) *store.Timing {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var transfer time.Duration
+	if !t.firstByte.IsZero() {
+		transfer = end.Sub(t.firstByte)
+	}
+	return &store.Timing{
+		DNSMs:      t.dns.Milliseconds(),
+		ConnectMs:  t.connect.Milliseconds(),
+		TLSMs:      t.tls.Milliseconds(),
+		TTFBMs:     t.ttfb.Milliseconds(),
+		TransferMs: transfer.Milliseconds(),
+		TotalMs:    end.Sub(t.start).Milliseconds(),
+	}
+}
+
+// since returns the time since *start and clears it, or zero if the phase
+// never started
+func since(start *time.Time) time.Duration {
+	if start.IsZero() {
+		return 0
+	}
+	d := time.Since(*start)
+	*start = time.Time{}
+	return d
+}
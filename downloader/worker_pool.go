@@ -1,67 +1,581 @@
 package downloader
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"spamhaus/archive"
 	"spamhaus/store"
+	"strings"
 	"sync"
 	"time"
 )
 
+// WorkerPool downloads queued URLs. Queued tasks go to a dispatcher, which
+// hands them to workers as soon as the politeness limits of their host allow,
+// so tasks for other hosts keep flowing while one host is held back.
 type WorkerPool struct {
-	wg sync.WaitGroup
+	// wg counts the downloads queued by AddTask and Submit, for Wait. A
+	// batch of refetches is counted on its own instead.
+	wg       sync.WaitGroup
+	workers  sync.WaitGroup
+	store    store.Store
+	jobs     *Jobs
+	requests chan task
+	// slots holds a token for every task queued or waiting in the dispatcher,
+	// bounding both together by the queue size
+	slots chan struct{}
+	// ready hands tasks from the dispatcher to the workers, released wakes the
+	// dispatcher when a worker finishes a download
+	ready    chan task
+	released chan struct{}
+	limits   *hostLimits
+	// robots is nil unless robots.txt checks are enabled
+	robots *robotsCache
+	// archive is nil unless bodies are archived
+	archive *archive.Archive
+	// guard is nil unless the ssrf guard is enabled
+	guard *Guard
+	// quit is closed on shutdown to cut short workers waiting to retry
+	quit   chan struct{}
+	client *http.Client
+	config Config
 }
 
-var (
-	Requests = make(chan string)
-	finished = make(chan struct{})
-)
+// task is a queued download, jobID is empty for downloads nobody is polling
+// for such as batch refetches. submitted is the form the URL was submitted
+// in, if it isn't the URL itself, and refetch is set for downloads that
+// weren't submitted. done is marked once the download is over.
+type task struct {
+	url       string
+	submitted string
+	jobID     string
+	refetch   bool
+	done      *sync.WaitGroup
+	host      string
+	domain    string
+}
+
+func newTask(url, submitted, jobID string) task {
+	host, domain := hostKeys(url)
+	if submitted == url {
+		submitted = ""
+	}
+	return task{url: url, submitted: submitted, jobID: jobID, host: host, domain: domain}
+}
+
+// Config holds the downloader section of config.yaml
+type Config struct {
+	WorkerPoolSize       int `yaml:"worker_pool_size"`
+	QueueSize            int `yaml:"queue_size"`
+	NumOfBatchURLs       int `yaml:"num_of_batch_urls"`
+	BatchIntervalSeconds int `yaml:"batch_interval_seconds"`
+	MaxFinishedJobs      int `yaml:"max_finished_jobs"`
+	JobRetentionSeconds  int `yaml:"job_retention_seconds"`
+	// BatchWindowSeconds picks the URLs to refetch by their submissions over
+	// one of the store's windows rather than ever, 0 counts every submission
+	BatchWindowSeconds int `yaml:"batch_window_seconds"`
+
+	// RecordHeaders names the response headers stored with each download
+	RecordHeaders []string `yaml:"record_headers"`
+	// ConditionalRequests sends the ETag and Last-Modified of the body last
+	// downloaded on refetches, so an unchanged body comes back as a 304
+	ConditionalRequests bool `yaml:"conditional_requests"`
 
-func NewWorkerPool(poolSize int) *WorkerPool {
-	pool := &WorkerPool{}
+	Client     ClientConfig     `yaml:"client"`
+	Retry      RetryConfig      `yaml:"retry"`
+	Politeness PolitenessConfig `yaml:"politeness"`
+	Robots     RobotsConfig     `yaml:"robots"`
+	Body       BodyConfig       `yaml:"body"`
+	SSRF       GuardConfig      `yaml:"ssrf"`
+}
+
+// NewWorkerPool starts cfg.WorkerPoolSize workers. Up to cfg.QueueSize tasks,
+// at least one, can wait for a free worker before AddTask blocks. Successful
+// downloads are written to blobs unless it is nil.
+func NewWorkerPool(cfg Config, s store.Store, blobs *archive.Archive) (*WorkerPool, error) {
+	// The client's timeout would cut the download short first, recording a
+	// timeout rather than the abort
+	timeout := seconds(cfg.Client.TimeoutSeconds, defaultTimeout)
+	if maxDuration := time.Duration(cfg.Body.MaxDurationSeconds) * time.Second; maxDuration >= timeout {
+		return nil, fmt.Errorf("downloader: body max_duration_seconds %d has to be below the client's timeout of %s", cfg.Body.MaxDurationSeconds, timeout)
+	}
 
-	for i := 0; i < poolSize; i++ {
+	guard, err := NewGuard(cfg.SSRF)
+	if err != nil {
+		return nil, err
+	}
+	client, err := NewHTTPClient(cfg.Client, guard)
+	if err != nil {
+		return nil, err
+	}
+
+	queueSize := max(cfg.QueueSize, 1)
+	pool := &WorkerPool{
+		store:    s,
+		jobs:     NewJobs(cfg.MaxFinishedJobs, time.Duration(cfg.JobRetentionSeconds)*time.Second),
+		requests: make(chan task, queueSize),
+		slots:    make(chan struct{}, queueSize),
+		ready:    make(chan task),
+		released: make(chan struct{}, 1),
+		limits:   newHostLimits(cfg.Politeness),
+		quit:     make(chan struct{}),
+		client:   client,
+		config:   cfg,
+		archive:  blobs,
+		guard:    guard,
+	}
+	if cfg.Robots.Enabled {
+		pool.robots = newRobotsCache(cfg.Robots, client, cfg.Client)
+	}
+
+	pool.workers.Add(1)
+	go pool.dispatch()
+	for i := 0; i < cfg.WorkerPoolSize; i++ {
+		pool.workers.Add(1)
 		go pool.worker()
 	}
 
-	return pool
+	return pool, nil
 }
 
-// Shutdown closes the Requests channel to prevent more requests coming in
-// then blocks on the finished channel
+// Shutdown closes the requests channel to prevent more requests coming in
+// then blocks until every queued task has been downloaded. Pending retries
+// are given up and rate limits no longer apply to what is left.
 func (wp *WorkerPool) Shutdown() {
 	log.Println("workerpool: attempting graceful shutdown")
-	close(Requests)
-	<-finished
+	close(wp.quit)
+	close(wp.requests)
+	wp.workers.Wait()
 	log.Println("workerpool: shutdown complete")
 }
 
-func AddTask(url string) {
+// AddTask queues a refetch of the URL, a download that isn't counted as a
+// submission of it
+func (wp *WorkerPool) AddTask(url string) {
+	wp.wg.Add(1)
+	wp.queueRefetch(url, &wp.wg)
+}
+
+// Refetch queues a refetch of each URL and waits for them to finish, but not
+// for any other download in the pool, so a batch isn't held up by steady
+// submissions
+func (wp *WorkerPool) Refetch(urls []string) {
+	var done sync.WaitGroup
+	done.Add(len(urls))
+	for _, url := range urls {
+		wp.queueRefetch(url, &done)
+	}
+	done.Wait()
+}
+
+func (wp *WorkerPool) queueRefetch(url string, done *sync.WaitGroup) {
 	log.Printf("adding download task to worker pool URL: %s", url)
-	Requests <- url
+	t := newTask(url, "", "")
+	t.refetch = true
+	t.done = done
+	wp.slots <- struct{}{}
+	wp.requests <- t
+}
+
+// Submit creates a job for the URL and queues its download. submitted is the
+// form the URL was given in before it was canonicalised, it is recorded with
+// the download. If the queue is still full when ctx is done the job is
+// dropped and ctx's error returned.
+func (wp *WorkerPool) Submit(ctx context.Context, url, submitted string) (Job, error) {
+	log.Printf("adding download job to worker pool URL: %s", url)
+	job := wp.jobs.create(url)
+	wp.wg.Add(1)
+
+	// Prefer queuing when there is room, even if ctx is already done
+	select {
+	case wp.slots <- struct{}{}:
+	default:
+		select {
+		case wp.slots <- struct{}{}:
+		case <-ctx.Done():
+			wp.wg.Done()
+			wp.jobs.remove(job.ID)
+			return Job{}, ctx.Err()
+		}
+	}
+
+	t := newTask(url, submitted, job.ID)
+	t.done = &wp.wg
+	wp.requests <- t
+	return job, nil
+}
+
+// Check reports why the URL won't be downloaded, which can only be the ssrf
+// guard refusing it
+func (wp *WorkerPool) Check(ctx context.Context, url string) error {
+	if wp.guard == nil {
+		return nil
+	}
+	return wp.guard.CheckURL(ctx, url)
+}
+
+// Job returns the current state of a job created by Submit
+func (wp *WorkerPool) Job(id string) (Job, bool) {
+	return wp.jobs.Get(id)
+}
+
+// dispatch moves queued tasks into a wait queue and hands them to workers,
+// oldest first, once their host and domain are within their limits. When
+// robots.txt checks are on, a host's robots.txt is fetched in place of its
+// first task and the host held until it is in, so its crawl delay applies
+// to every download.
+func (wp *WorkerPool) dispatch() {
+	defer wp.workers.Done()
+	defer close(wp.ready)
+
+	prune := time.NewTicker(time.Minute)
+	defer prune.Stop()
+
+	waiting := newWaitQueue()
+	loaded := make(chan string)
+	requests, quit := wp.requests, wp.quit
+	rateLimited := true
+	for requests != nil || waiting.size > 0 {
+		var ready chan task
+		var wake <-chan time.Time
+		next, wait, ok := waiting.next(wp.limits, time.Now(), rateLimited)
+		if ok && !wp.robotsCached(next) {
+			// The fetch counts against the host's limits like a download
+			wp.limits.start(next, time.Now())
+			waiting.hold(next.host)
+			go wp.loadRobots(next, loaded)
+			continue
+		}
+		if ok {
+			ready = wp.ready
+		} else if wait > 0 {
+			wake = time.After(wait)
+		}
+
+		select {
+		case t, open := <-requests:
+			if !open {
+				requests = nil
+				continue
+			}
+			waiting.push(t)
+		case ready <- next:
+			wp.limits.start(next, time.Now())
+			waiting.remove(next.host)
+			<-wp.slots
+		case host := <-loaded:
+			waiting.release(host)
+		case <-wp.released:
+		case <-wake:
+		case <-quit:
+			quit, rateLimited = nil, false
+		case <-prune.C:
+			wp.limits.prune(time.Now())
+		}
+	}
 }
 
 func (wp *WorkerPool) worker() {
-	for url := range Requests {
-		wp.wg.Add(1)
-		start := time.Now()
-		resp, err := http.Get(url)
-		if err != nil {
-			log.Printf("worker pool error: downloading %s, %v", url, err)
-			return
+	defer wp.workers.Done()
+	for t := range wp.ready {
+		wp.run(t)
+		wp.limits.finish(t, time.Now())
+		select {
+		case wp.released <- struct{}{}:
+		default:
+		}
+		t.done.Done()
+	}
+}
+
+// run downloads the task and, if it has one, keeps its job up to date
+func (wp *WorkerPool) run(t task) {
+	if t.jobID == "" {
+		wp.download(t)
+		return
+	}
+
+	wp.jobs.start(t.jobID)
+	attempt, stored := wp.download(t)
+	status := JobFailed
+	switch {
+	case attempt.Success:
+		status = JobSucceeded
+	case attempt.Blocked():
+		status = JobBlocked
+	case attempt.Aborted():
+		status = JobAborted
+	case !stored:
+		status = JobDiscarded
+	}
+	wp.jobs.finish(t.jobID, status, attempt.StatusCode, attempt.DurationMs, attempt.Error)
+}
+
+// download fetches the URL, trying again as long as the retry policy allows,
+// and records every attempt in the store. It returns the last attempt and
+// whether the store kept the URL.
+func (wp *WorkerPool) download(t task) (store.Attempt, bool) {
+	if attempt, blocked := wp.checkRobots(t); blocked {
+		attempt.Submitted, attempt.Refetch = t.submitted, t.refetch
+		log.Printf("worker pool: %s is disallowed by robots.txt", t.url)
+		return attempt, wp.store.Update(t.url, attempt)
+	}
+
+	url, policy := t.url, wp.config.Retry
+	conditions := wp.conditions(url)
+	for try := 1; ; try++ {
+		attempt, resp, err := wp.fetch(url, conditions)
+		attempt.Try = try
+		attempt.Submitted, attempt.Refetch = t.submitted, t.refetch
+
+		var wait time.Duration
+		retry := policy.shouldRetry(try, resp, err)
+		if retry {
+			wait, retry = policy.backoff(try, resp)
+		}
+		attempt.Retrying = retry
+		if !retry {
+			return attempt, wp.store.Update(url, attempt)
 		}
-		duration := time.Since(start).Milliseconds()
-		defer resp.Body.Close()
 
-		_, err = io.Copy(ioutil.Discard, resp.Body)
-		store.Update(url, err == nil && resp.StatusCode == 200, duration)
+		// The retry counts against the host's rate limit like any download
+		wait = max(wait, wp.limits.reserve(t, time.Now()))
+		log.Printf("worker pool: retrying %s in %s after try %d: %s", url, wait, try, attempt.Error)
+		wp.jobs.retry(t.jobID, try+1)
+		select {
+		case <-time.After(wait):
+			wp.store.Update(url, attempt)
+		case <-wp.quit:
+			// The try is recorded as the last one, so the store decides
+			// whether the URL is kept rather than waiting for another
+			log.Printf("worker pool: giving up retrying %s on shutdown", url)
+			attempt.Retrying = false
+			return attempt, wp.store.Update(url, attempt)
+		}
+	}
+}
+
+// robotsCached reports whether the task can be handed to a worker without
+// fetching its site's robots.txt first
+func (wp *WorkerPool) robotsCached(t task) bool {
+	if wp.robots == nil {
+		return true
+	}
+	u, err := url.Parse(t.url)
+	if err != nil {
+		return true
+	}
+	_, ok := wp.robots.cached(u)
+	return ok
+}
+
+// loadRobots fetches the robots.txt of the task's site for the dispatcher,
+// which has started it like a download of the task, and passes the site's
+// crawl delay on to the host limits before the host is released
+func (wp *WorkerPool) loadRobots(t task, loaded chan<- string) {
+	if u, err := url.Parse(t.url); err == nil {
+		rules := wp.robots.rules(u)
+		wp.limits.setCrawlDelay(t.host, rules.crawlDelay)
+	}
+	wp.limits.finish(t, time.Now())
+	loaded <- t.host
+}
+
+// checkRobots looks the task's URL up in its site's robots.txt, when that is
+// enabled. If the URL is disallowed it returns the attempt to record instead
+// of downloading it.
+func (wp *WorkerPool) checkRobots(t task) (store.Attempt, bool) {
+	if wp.robots == nil {
+		return store.Attempt{}, false
+	}
+	u, err := url.Parse(t.url)
+	if err != nil {
+		return store.Attempt{}, false
+	}
+
+	rules := wp.robots.rules(u)
+
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	if u.RawQuery != "" {
+		path += "?" + u.RawQuery
+	}
+	if rules.allowed(path) {
+		return store.Attempt{}, false
+	}
+
+	return store.Attempt{
+		At:      time.Now(),
+		Try:     1,
+		Error:   "blocked by robots.txt",
+		Outcome: store.OutcomeBlockedRobots,
+	}, true
+}
+
+// conditions returns the conditional request headers for a URL whose body
+// the store already has validators for, nil if it has none or conditional
+// requests are off
+func (wp *WorkerPool) conditions(url string) http.Header {
+	if !wp.config.ConditionalRequests {
+		return nil
+	}
+	node, ok := wp.store.Get(url)
+	if !ok {
+		return nil
+	}
+
+	conditions := make(http.Header)
+	if node.Data.ETag != "" {
+		conditions.Set("If-None-Match", node.Data.ETag)
+	}
+	if node.Data.LastModified != "" {
+		conditions.Set("If-Modified-Since", node.Data.LastModified)
+	}
+	if len(conditions) == 0 {
+		return nil
+	}
+	return conditions
+}
+
+// fetch makes a single download of the URL, adding the conditions to the
+// request if there are any. Besides the attempt it returns the response, its
+// body already closed, and the error that ended the download, either of
+// which may be nil.
+func (wp *WorkerPool) fetch(url string, conditions http.Header) (store.Attempt, *http.Response, error) {
+	start := time.Now()
+	attempt := store.Attempt{At: start}
+
+	req, err := newRequest(wp.config.Client, url)
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt, nil, err
+	}
+	for name, values := range conditions {
+		req.Header[name] = values
+	}
+	timer := newTimer(start)
+	ctx, limits := limitBody(req.Context(), wp.config.Body)
+	ctx, redirects := withRedirectRecorder(ctx, start)
+	req = req.WithContext(httptrace.WithClientTrace(ctx, timer.trace()))
+
+	resp, err := wp.client.Do(req)
+	attempt.Redirects = redirects.hops
+	if err != nil {
+		err = limits.finish(err)
+		log.Printf("worker pool error: downloading %s, %v", url, err)
+		attempt.Timing = timer.finish(time.Now())
+		attempt.DurationMs = attempt.Timing.TotalMs
+		attempt.Error = err.Error()
+		markAborted(&attempt, err)
+		return attempt, nil, err
+	}
+	wp.describe(&attempt, resp)
+	defer resp.Body.Close()
 
-		wp.wg.Done()
+	fp := newFingerprint(attempt.ContentType)
+	var body io.Writer = fp
+	blob := wp.createBlob(resp)
+	if blob != nil {
+		body = io.MultiWriter(fp, blob)
+	}
+	attempt.Bytes, err = io.Copy(body, limits.wrap(resp.Body))
+	err = limits.finish(err)
+	// The download only ends once the whole body is in
+	attempt.Timing = timer.finish(time.Now())
+	attempt.DurationMs = attempt.Timing.TotalMs
+	notModified := resp.StatusCode == http.StatusNotModified && conditions != nil
+	switch {
+	case err != nil:
+		attempt.Error = err.Error()
+		markAborted(&attempt, err)
+	case notModified:
+		attempt.Outcome = store.OutcomeNotModified
+	case resp.StatusCode != 200:
+		attempt.Error = fmt.Sprintf("unexpected status %s", resp.Status)
+	}
+	attempt.Success = err == nil && (resp.StatusCode == 200 || notModified)
+	if attempt.Success && !notModified {
+		attempt.SHA256, attempt.TextHash = fp.sums()
+	}
+	if blob != nil {
+		attempt.Blob = wp.commitBlob(blob, attempt.Success)
+	}
+	return attempt, resp, err
+}
+
+// markAborted sets the aborted outcome on an attempt a body limit cut short,
+// its Bytes are what was read up to then
+func markAborted(attempt *store.Attempt, err error) {
+	var abort *abortError
+	if errors.As(err, &abort) {
+		attempt.Outcome = store.OutcomeAborted
+	}
+}
+
+// createBlob starts archiving the body of a successful response, it returns
+// nil if archiving is off or the body isn't worth keeping
+func (wp *WorkerPool) createBlob(resp *http.Response) *archive.Writer {
+	if wp.archive == nil || resp.StatusCode != 200 {
+		return nil
+	}
+	blob, err := wp.archive.Create()
+	if err != nil {
+		log.Printf("worker pool error: archiving %s, %v", resp.Request.URL, err)
+		return nil
+	}
+	return blob
+}
+
+// commitBlob stores the archived body if the download succeeded and returns
+// its hash, or throws it away
+func (wp *WorkerPool) commitBlob(blob *archive.Writer, success bool) string {
+	if !success {
+		blob.Abort()
+		return ""
+	}
+	hash, err := blob.Commit()
+	if err != nil {
+		log.Printf("worker pool error: %v", err)
+		return ""
+	}
+	return hash
+}
+
+// describe copies the response metadata onto the attempt
+func (wp *WorkerPool) describe(attempt *store.Attempt, resp *http.Response) {
+	attempt.StatusCode = resp.StatusCode
+	attempt.ContentType = resp.Header.Get("Content-Type")
+	attempt.ContentEncoding = resp.Header.Get("Content-Encoding")
+	if resp.Uncompressed {
+		// The transport asked for gzip itself and has already removed the
+		// header while decoding the body
+		attempt.ContentEncoding = "gzip"
+	}
+	attempt.Server = resp.Header.Get("Server")
+	attempt.FinalURL = resp.Request.URL.String()
+	attempt.ETag = resp.Header.Get("ETag")
+	attempt.LastModified = resp.Header.Get("Last-Modified")
+
+	for _, name := range wp.config.RecordHeaders {
+		if value := resp.Header.Values(name); len(value) > 0 {
+			if attempt.Headers == nil {
+				attempt.Headers = make(map[string]string)
+			}
+			attempt.Headers[http.CanonicalHeaderKey(name)] = strings.Join(value, ", ")
+		}
 	}
 }
 
+// Wait waits for the downloads queued by AddTask and Submit to finish. No
+// more may be queued while it waits, a batch waits with Refetch instead.
 func (wp *WorkerPool) Wait() {
 	wp.wg.Wait()
 }
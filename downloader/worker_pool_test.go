@@ -1,33 +1,58 @@
 package downloader
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"spamhaus/archive"
+	"spamhaus/store"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
 
 func TestWorkerPoolConcurrency(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	// Each download takes 100ms so running them one after the other would
+	// take at least 100ms per url
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
 	tests := []struct {
-		name           string
-		poolSize       int
-		taskURLs       []string
-		expectedLogMsg string
+		name     string
+		poolSize int
+		taskURLs []string
 	}{
 		{
 			name:     "Multiple workers with concurrent tasks",
 			poolSize: 3,
-			taskURLs: []string{"http://google.com", "http://google.co.uk", "https://google.cz"},
+			taskURLs: []string{server.URL + "/a", server.URL + "/b", server.URL + "/c"},
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			// Capture log output
-
-			wp := NewWorkerPool(tt.poolSize)
+			s := store.NewMemoryStore(store.Config{})
+			wp, err := NewWorkerPool(Config{WorkerPoolSize: tt.poolSize}, s, nil)
+			if err != nil {
+				t.Fatalf("could not create worker pool: %v", err)
+			}
+			defer wp.Shutdown()
 			startTime := time.Now()
 
 			for _, url := range tt.taskURLs {
-				AddTask(url)
+				wp.AddTask(url)
 			}
 
 			wp.Wait()
@@ -41,6 +66,1225 @@ func TestWorkerPoolConcurrency(t *testing.T) {
 					time.Duration(len(tt.taskURLs))*100*time.Millisecond, duration)
 			}
 
+			// Every download should have been recorded in the store
+			stored := s.Filter(store.Query{Limit: len(tt.taskURLs)})
+			if len(stored) != len(tt.taskURLs) {
+				t.Errorf("expected %d urls in the store, got %d", len(tt.taskURLs), len(stored))
+			}
+			// Tasks are refetches rather than submissions
+			for _, node := range stored {
+				if node.Data.Count != 0 || node.Data.Fetches != 1 {
+					t.Errorf("expected %s to be fetched once without being submitted, got %+v", node.URL, node.Data)
+				}
+			}
+		})
+	}
+}
+
+// TestWorkerPoolBackpressure ensures Submit gives up once the queue is full
+// and the context is done
+func TestWorkerPoolBackpressure(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+
+	wp, err := NewWorkerPool(Config{WorkerPoolSize: 1, QueueSize: 1}, store.NewMemoryStore(store.Config{}), nil)
+	if err != nil {
+		t.Fatalf("could not create worker pool: %v", err)
+	}
+	// Let the downloads finish before shutting down, which waits for them
+	defer wp.Shutdown()
+	defer close(release)
+
+	// Keep the only worker busy so nothing else is taken off the queue
+	busy, _ := wp.Submit(context.Background(), server.URL+"/busy", "")
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(time.Millisecond) {
+		if job, _ := wp.Job(busy.ID); job.Status == JobRunning {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the first job to start")
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	job, err := wp.Submit(ctx, server.URL+"/a", "")
+	if err != nil {
+		t.Fatalf("expected the second job to be queued, got %v", err)
+	}
+	if queued, _ := wp.Job(job.ID); queued.Status != JobQueued {
+		t.Errorf("expected the second job to be queued, got %s", queued.Status)
+	}
+
+	if _, err := wp.Submit(ctx, server.URL+"/b", ""); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the third job to time out, got %v", err)
+	}
+}
+
+// TestWorkerPoolRefetch ensures a batch of refetches only waits for its own
+// downloads, not for submissions still being downloaded
+func TestWorkerPoolRefetch(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-release
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	s := store.NewMemoryStore(store.Config{})
+	wp, err := NewWorkerPool(Config{WorkerPoolSize: 2}, s, nil)
+	if err != nil {
+		t.Fatalf("could not create worker pool: %v", err)
+	}
+	defer wp.Shutdown()
+
+	job, _ := wp.Submit(context.Background(), server.URL+"/slow", "")
+	refetched := make(chan struct{})
+	go func() {
+		// Another host, so the politeness limits don't hold it back
+		wp.Refetch([]string{strings.Replace(server.URL, "127.0.0.1", "localhost", 1) + "/fast"})
+		close(refetched)
+	}()
+
+	select {
+	case <-refetched:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("expected the refetch not to wait for the submission")
+	}
+	if job, _ := wp.Job(job.ID); job.Status != JobRunning {
+		t.Errorf("expected the submission to still be running, got %s", job.Status)
+	}
+
+	close(release)
+	wp.Wait()
+	if job, _ := wp.Job(job.ID); job.Status != JobSucceeded {
+		t.Errorf("expected the submission to succeed, got %s", job.Status)
+	}
+}
+
+// TestWorkerPoolJobs checks the final status of submitted jobs
+func TestWorkerPoolJobs(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/broken" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	s := store.NewMemoryStore(store.Config{})
+	wp, err := NewWorkerPool(Config{WorkerPoolSize: 1}, s, nil)
+	if err != nil {
+		t.Fatalf("could not create worker pool: %v", err)
+	}
+	defer wp.Shutdown()
+
+	// Store a url first so its next failure is kept rather than discarded
+	s.Update(server.URL+"/broken?stored", store.Attempt{Success: true})
+
+	tests := []struct {
+		url            string
+		expectedStatus string
+		expectedCode   int
+	}{
+		{url: server.URL + "/ok", expectedStatus: JobSucceeded, expectedCode: http.StatusOK},
+		{url: server.URL + "/broken", expectedStatus: JobDiscarded, expectedCode: http.StatusInternalServerError},
+		{url: server.URL + "/broken?stored", expectedStatus: JobFailed, expectedCode: http.StatusInternalServerError},
+		{url: "http://127.0.0.1:0/unreachable", expectedStatus: JobDiscarded},
+	}
+
+	jobs := make([]Job, 0, len(tests))
+	for _, tt := range tests {
+		job, err := wp.Submit(context.Background(), tt.url, "")
+		if err != nil {
+			t.Fatalf("could not submit %s: %v", tt.url, err)
+		}
+		jobs = append(jobs, job)
+	}
+	wp.Wait()
+
+	for i, tt := range tests {
+		job, ok := wp.Job(jobs[i].ID)
+		if !ok {
+			t.Fatalf("job for %s not found", tt.url)
+		}
+		if job.Status != tt.expectedStatus || job.StatusCode != tt.expectedCode || job.FinishedAt == nil {
+			t.Errorf("expected %s to be %s with status code %d, got %+v", tt.url, tt.expectedStatus, tt.expectedCode, job)
+		}
+	}
+}
+
+// TestJobsRetention ensures only the most recent finished jobs are kept
+func TestJobsRetention(t *testing.T) {
+	jobs := NewJobs(2, time.Hour)
+
+	ids := make([]string, 0, 3)
+	for i := 0; i < 3; i++ {
+		job := jobs.create(fmt.Sprintf("http://example%d.com", i))
+		jobs.finish(job.ID, JobSucceeded, http.StatusOK, 10, "")
+		ids = append(ids, job.ID)
+	}
+	pending := jobs.create("http://pending.com")
+
+	if _, ok := jobs.Get(ids[0]); ok {
+		t.Errorf("expected the oldest finished job to be dropped")
+	}
+	for _, id := range append(ids[1:], pending.ID) {
+		if _, ok := jobs.Get(id); !ok {
+			t.Errorf("expected job %s to be kept", id)
+		}
+	}
+}
+
+// TestWorkerPoolClient ensures downloads use the configured user agent,
+// headers and redirect limit
+func TestWorkerPoolClient(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("User-Agent") != "test-agent" || r.Header.Get("X-Team") != "abuse" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if r.URL.Path == "/loop" {
+			http.Redirect(w, r, "/loop", http.StatusFound)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	s := store.NewMemoryStore(store.Config{})
+	wp, err := NewWorkerPool(Config{
+		WorkerPoolSize: 1,
+		Client: ClientConfig{
+			UserAgent:    "test-agent",
+			Headers:      map[string]string{"X-Team": "abuse"},
+			MaxRedirects: 2,
+		},
+	}, s, nil)
+	if err != nil {
+		t.Fatalf("could not create worker pool: %v", err)
+	}
+	defer wp.Shutdown()
+
+	ok, _ := wp.Submit(context.Background(), server.URL+"/ok", "")
+	loop, _ := wp.Submit(context.Background(), server.URL+"/loop", "")
+	wp.Wait()
+
+	if job, _ := wp.Job(ok.ID); job.Status != JobSucceeded {
+		t.Errorf("expected the download with the configured headers to succeed, got %+v", job)
+	}
+	if job, _ := wp.Job(loop.ID); job.Status != JobDiscarded || !strings.Contains(job.Error, "stopped after 2 redirects") {
+		t.Errorf("expected the redirect loop to be stopped, got %+v", job)
+	}
+	// The hop that went over the limit wasn't followed, so isn't recorded
+	if r, _ := s.GetRejected(server.URL + "/loop"); len(r.Attempts) != 1 || len(r.Attempts[0].Redirects) != 2 {
+		t.Errorf("expected the 2 followed redirects to be recorded, got %+v", r.Attempts)
+	}
+
+	if _, err := NewWorkerPool(Config{Client: ClientConfig{CABundle: "missing.pem"}}, s, nil); err == nil {
+		t.Errorf("expected a missing ca bundle to be an error")
+	}
+}
+
+// TestWorkerPoolRetry ensures transient failures are retried and every try is
+// recorded, while permanent ones are given up straight away
+func TestWorkerPoolRetry(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	var mu sync.Mutex
+	tries := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		tries[r.URL.Path]++
+		try := tries[r.URL.Path]
+		mu.Unlock()
+
+		switch {
+		case r.URL.Path == "/flaky" && try < 3:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case r.URL.Path == "/throttled":
+			w.Header().Set("Retry-After", "3600")
+			w.WriteHeader(http.StatusTooManyRequests)
+		case r.URL.Path == "/missing":
+			w.WriteHeader(http.StatusNotFound)
+		case r.URL.Path == "/down":
+			w.WriteHeader(http.StatusBadGateway)
+		default:
+			w.Write([]byte("ok"))
+		}
+	}))
+	defer server.Close()
+
+	s := store.NewMemoryStore(store.Config{})
+	wp, err := NewWorkerPool(Config{
+		WorkerPoolSize: 2,
+		Retry: RetryConfig{
+			MaxAttempts:          3,
+			BaseBackoffMs:        1,
+			MaxBackoffMs:         1000,
+			Jitter:               0.5,
+			RetryableStatusCodes: []int{429, 502, 503},
+			RespectRetryAfter:    true,
+		},
+	}, s, nil)
+	if err != nil {
+		t.Fatalf("could not create worker pool: %v", err)
+	}
+	defer wp.Shutdown()
+
+	tests := []struct {
+		path             string
+		expectedStatus   string
+		expectedAttempts int
+	}{
+		{path: "/flaky", expectedStatus: JobSucceeded, expectedAttempts: 3},
+		{path: "/throttled", expectedStatus: JobDiscarded, expectedAttempts: 1},
+		{path: "/missing", expectedStatus: JobDiscarded, expectedAttempts: 1},
+		{path: "/down", expectedStatus: JobDiscarded, expectedAttempts: 3},
+	}
+
+	jobs := make([]Job, 0, len(tests))
+	for _, tt := range tests {
+		job, err := wp.Submit(context.Background(), server.URL+tt.path, "")
+		if err != nil {
+			t.Fatalf("could not submit %s: %v", tt.path, err)
+		}
+		jobs = append(jobs, job)
+	}
+	wp.Wait()
+
+	for i, tt := range tests {
+		job, _ := wp.Job(jobs[i].ID)
+		if job.Status != tt.expectedStatus || job.Attempts != tt.expectedAttempts || tries[tt.path] != tt.expectedAttempts {
+			t.Errorf("expected %s to be %s after %d attempts, got %+v and %d requests",
+				tt.path, tt.expectedStatus, tt.expectedAttempts, job, tries[tt.path])
+		}
+	}
+
+	node, ok := s.Get(server.URL + "/flaky")
+	if !ok {
+		t.Fatalf("expected the flaky url to be stored")
+	}
+	if node.Data.Count != 1 || node.Data.Successes != 1 || node.Data.Failures != 2 || node.Data.History.Len() != 3 {
+		t.Errorf("expected one submission with two failed tries, got %+v", node.Data)
+	}
+	if _, ok := s.Get(server.URL + "/down"); ok {
+		t.Errorf("expected a url that never downloaded to be discarded")
+	}
+}
+
+// TestWorkerPoolShutdownRetry ensures a download waiting to be retried when
+// the pool shuts down is recorded as over, so a new URL is rejected rather
+// than left waiting for a try that never comes
+func TestWorkerPoolShutdownRetry(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	s := store.NewMemoryStore(store.Config{})
+	wp, err := NewWorkerPool(Config{
+		WorkerPoolSize: 1,
+		Retry:          RetryConfig{MaxAttempts: 3, BaseBackoffMs: 3600000, MaxBackoffMs: 3600000, RetryableStatusCodes: []int{503}},
+	}, s, nil)
+	if err != nil {
+		t.Fatalf("could not create worker pool: %v", err)
+	}
+
+	job, _ := wp.Submit(context.Background(), server.URL, "")
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(time.Millisecond) {
+		if job, _ := wp.Job(job.ID); job.Attempts == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected a retry to be scheduled")
+		}
+	}
+	wp.Shutdown()
+
+	if job, _ := wp.Job(job.ID); job.Status != JobDiscarded {
+		t.Errorf("expected the job to be discarded, got %+v", job)
+	}
+	rejected, ok := s.GetRejected(server.URL)
+	if !ok || rejected.Tries != 1 || rejected.Attempts[0].Retrying {
+		t.Errorf("expected the url to be rejected after its only try, got %+v", rejected)
+	}
+}
+
+// TestRetryBackoff checks the backoff grows exponentially up to the maximum
+// and that jitter only ever shortens it
+func TestRetryBackoff(t *testing.T) {
+	policy := RetryConfig{BaseBackoffMs: 100, MaxBackoffMs: 1000, Jitter: 0.2}
+
+	tests := []struct {
+		try     int
+		longest time.Duration
+	}{
+		{try: 1, longest: 100 * time.Millisecond},
+		{try: 2, longest: 200 * time.Millisecond},
+		{try: 4, longest: 800 * time.Millisecond},
+		{try: 10, longest: time.Second},
+	}
+
+	for _, tt := range tests {
+		wait, ok := policy.backoff(tt.try, nil)
+		if !ok || wait > tt.longest || wait < tt.longest*8/10 {
+			t.Errorf("expected try %d to wait between %s and %s, got %s", tt.try, tt.longest*8/10, tt.longest, wait)
+		}
+	}
+
+	resp := &http.Response{StatusCode: http.StatusServiceUnavailable, Header: http.Header{"Retry-After": {"2"}}}
+	policy.RespectRetryAfter = true
+	if _, ok := policy.backoff(1, resp); ok {
+		t.Errorf("expected a Retry-After beyond the maximum backoff to stop retries")
+	}
+	policy.MaxBackoffMs = 5000
+	if wait, ok := policy.backoff(1, resp); !ok || wait != 2*time.Second {
+		t.Errorf("expected to wait the 2s asked for by Retry-After, got %s", wait)
+	}
+}
+
+// TestWorkerPoolPoliteness ensures a host is never downloaded from more than
+// its limits allow, while tasks for other hosts keep being downloaded
+func TestWorkerPoolPoliteness(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	var mu sync.Mutex
+	active, peak := make(map[string]int), make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := strings.Split(r.Host, ":")[0]
+		mu.Lock()
+		active[host]++
+		peak[host] = max(peak[host], active[host])
+		mu.Unlock()
+
+		if host == "localhost" {
+			time.Sleep(50 * time.Millisecond)
+		}
+		w.Write([]byte("ok"))
+
+		mu.Lock()
+		active[host]--
+		mu.Unlock()
+	}))
+	defer server.Close()
+	port := strings.Split(server.URL, ":")[2]
+
+	s := store.NewMemoryStore(store.Config{})
+	wp, err := NewWorkerPool(Config{
+		WorkerPoolSize: 4,
+		QueueSize:      10,
+		Politeness: PolitenessConfig{
+			PerHost: LimitConfig{MaxConcurrent: 1, RequestsPerSecond: 20},
+		},
+	}, s, nil)
+	if err != nil {
+		t.Fatalf("could not create worker pool: %v", err)
+	}
+	defer wp.Shutdown()
+
+	start := time.Now()
+	slow := make([]Job, 0, 4)
+	for i := 0; i < 4; i++ {
+		job, _ := wp.Submit(context.Background(), fmt.Sprintf("http://localhost:%s/%d", port, i), "")
+		slow = append(slow, job)
+	}
+	fast, _ := wp.Submit(context.Background(), fmt.Sprintf("http://127.0.0.1:%s/fast", port), "")
+
+	deadline := time.Now().Add(time.Second)
+	for job, _ := wp.Job(fast.ID); job.Status != JobSucceeded && time.Now().Before(deadline); job, _ = wp.Job(fast.ID) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if job, _ := wp.Job(slow[len(slow)-1].ID); job.Status == JobSucceeded {
+		t.Errorf("expected the other host to be downloaded before the limited host's queue drained")
+	}
+
+	wp.Wait()
+	// Four downloads of 50ms each, one at a time
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("expected the limited host to be downloaded one at a time, took %s", elapsed)
+	}
+	if peak["localhost"] != 1 {
+		t.Errorf("expected at most one concurrent download from localhost, got %d", peak["localhost"])
+	}
+}
+
+// TestHostLimitsRate ensures the token bucket only lets requests through at
+// the configured rate once its burst is used up
+func TestHostLimitsRate(t *testing.T) {
+	limits := newHostLimits(PolitenessConfig{
+		PerHost:   LimitConfig{RequestsPerSecond: 10, Burst: 2},
+		PerDomain: LimitConfig{MaxConcurrent: 1},
+	})
+	now := time.Now()
+	a, b := newTask("http://a.example.com", "", ""), newTask("http://b.example.com", "", "")
+
+	if wait, ok := limits.wait(a, now, true); !ok || wait != 0 {
+		t.Fatalf("expected the first download to start straight away, got %s %v", wait, ok)
+	}
+	limits.start(a, now)
+	if _, ok := limits.wait(b, now, true); ok {
+		t.Errorf("expected b.example.com to wait for the running download of its domain")
+	}
+	limits.finish(a, now)
+
+	limits.start(a, now)
+	limits.finish(a, now)
+	if wait, ok := limits.wait(a, now, true); !ok || wait != 100*time.Millisecond {
+		t.Errorf("expected to wait 100ms once the burst is used up, got %s %v", wait, ok)
+	}
+	if wait, _ := limits.wait(a, now.Add(100*time.Millisecond), true); wait != 0 {
+		t.Errorf("expected a token to be available after 100ms, got %s", wait)
+	}
+	if wait, _ := limits.wait(a, now, false); wait != 0 {
+		t.Errorf("expected no wait when rate limits are off, got %s", wait)
+	}
+
+	c := newTask("http://c.example.com", "", "")
+	limits.setCrawlDelay(c.host, time.Second)
+	limits.start(c, now)
+	limits.finish(c, now)
+	if wait, _ := limits.wait(c, now.Add(time.Second/2), true); wait != time.Second/2 {
+		t.Errorf("expected the crawl delay to hold the next download back 500ms, got %s", wait)
+	}
+}
+
+func TestRegisteredDomain(t *testing.T) {
+	tests := map[string]string{
+		"example.com":         "example.com",
+		"www.example.com":     "example.com",
+		"a.b.example.com":     "example.com",
+		"www.example.co.uk":   "example.co.uk",
+		"shop.example.com.au": "example.com.au",
+		"www.example.io":      "example.io",
+		"localhost":           "localhost",
+		"127.0.0.1":           "127.0.0.1",
+		"www.example.com.":    "example.com",
+	}
+
+	for host, expected := range tests {
+		if domain := registeredDomain(host); domain != expected {
+			t.Errorf("expected %s to be registered under %s, got %s", host, expected, domain)
+		}
+	}
+}
+
+// TestParseRobots checks group selection and rule precedence
+func TestParseRobots(t *testing.T) {
+	body := []byte(`# comment
+User-agent: *
+Disallow: /
+
+User-agent: other-bot
+User-agent: URL-Downloader
+Disallow: /private
+Allow: /private/public
+Disallow: /*.pdf$
+Disallow: /search?q=
+Crawl-delay: 2
+
+User-agent: url-downloader
+Allow: /private/shared$
+`)
+	rules := parseRobots(body, "url-downloader")
+	if rules.crawlDelay != 2*time.Second {
+		t.Errorf("expected a crawl delay of 2s, got %s", rules.crawlDelay)
+	}
+
+	tests := []struct {
+		path    string
+		allowed bool
+	}{
+		{path: "/", allowed: true},
+		{path: "/private", allowed: false},
+		{path: "/private/page", allowed: false},
+		{path: "/private/public/page", allowed: true},
+		{path: "/private/shared", allowed: true},
+		{path: "/private/shared/page", allowed: false},
+		{path: "/docs/file.pdf", allowed: false},
+		{path: "/docs/file.pdf?download=1", allowed: true},
+		{path: "/search?q=abuse", allowed: false},
+		{path: "/robots.txt", allowed: true},
+	}
+	for _, tt := range tests {
+		if allowed := rules.allowed(tt.path); allowed != tt.allowed {
+			t.Errorf("expected %s allowed to be %v", tt.path, tt.allowed)
+		}
+	}
+
+	if fallback := parseRobots(body, "unknown-bot"); fallback.allowed("/anything") {
+		t.Errorf("expected the * group to disallow everything for other agents")
+	}
+}
+
+// TestWorkerPoolRobots ensures disallowed URLs are recorded as blocked
+// without being downloaded and that robots.txt is only fetched once
+func TestWorkerPoolRobots(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	var mu sync.Mutex
+	requests := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.URL.Path]++
+		mu.Unlock()
+
+		if r.URL.Path == "/robots.txt" {
+			w.Write([]byte("User-agent: *\nDisallow: /private\n"))
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	s := store.NewMemoryStore(store.Config{})
+	wp, err := NewWorkerPool(Config{WorkerPoolSize: 2, Robots: RobotsConfig{Enabled: true}}, s, nil)
+	if err != nil {
+		t.Fatalf("could not create worker pool: %v", err)
+	}
+	defer wp.Shutdown()
+
+	public, _ := wp.Submit(context.Background(), server.URL+"/public", "")
+	private, _ := wp.Submit(context.Background(), server.URL+"/private/page", "")
+	wp.Wait()
+
+	if job, _ := wp.Job(public.ID); job.Status != JobSucceeded {
+		t.Errorf("expected the allowed url to be downloaded, got %+v", job)
+	}
+	if job, _ := wp.Job(private.ID); job.Status != JobBlocked {
+		t.Errorf("expected the disallowed url to be blocked, got %+v", job)
+	}
+	if requests["/private/page"] != 0 || requests["/robots.txt"] != 1 {
+		t.Errorf("expected one robots.txt fetch and no request for the blocked url, got %v", requests)
+	}
+
+	node, ok := s.Get(server.URL + "/private/page")
+	if !ok {
+		t.Fatalf("expected the blocked url to be stored")
+	}
+	last := node.Data.History.Attempts()[0]
+	if node.Data.Blocked != 1 || node.Data.Failures != 0 || last.Outcome != store.OutcomeBlockedRobots {
+		t.Errorf("expected one blocked attempt, got %+v", node.Data)
+	}
+}
+
+// TestWorkerPoolRobotsCrawlDelay ensures the crawl delay applies from the
+// first download of a host and that fetching robots.txt counts against the
+// host's limits
+func TestWorkerPoolRobotsCrawlDelay(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	var mu sync.Mutex
+	var starts []time.Time
+	active, peak := 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		starts = append(starts, time.Now())
+		active++
+		peak = max(peak, active)
+		mu.Unlock()
+
+		if r.URL.Path == "/robots.txt" {
+			time.Sleep(20 * time.Millisecond)
+			w.Write([]byte("User-agent: *\nCrawl-delay: 0.1\n"))
+		} else {
+			w.Write([]byte("ok"))
+		}
+
+		mu.Lock()
+		active--
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	s := store.NewMemoryStore(store.Config{})
+	wp, err := NewWorkerPool(Config{
+		WorkerPoolSize: 3,
+		QueueSize:      3,
+		Robots:         RobotsConfig{Enabled: true},
+		Politeness: PolitenessConfig{
+			PerHost: LimitConfig{MaxConcurrent: 1},
+		},
+	}, s, nil)
+	if err != nil {
+		t.Fatalf("could not create worker pool: %v", err)
+	}
+	defer wp.Shutdown()
+
+	for i := 0; i < 2; i++ {
+		wp.Submit(context.Background(), fmt.Sprintf("%s/%d", server.URL, i), "")
+	}
+	wp.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(starts) != 3 {
+		t.Fatalf("expected robots.txt and two downloads, got %d requests", len(starts))
+	}
+	for i := 1; i < len(starts); i++ {
+		if gap := starts[i].Sub(starts[i-1]); gap < 100*time.Millisecond {
+			t.Errorf("expected request %d to start a crawl delay after the one before, got %s", i, gap)
+		}
+	}
+	if peak != 1 {
+		t.Errorf("expected robots.txt and the downloads one at a time, got %d at once", peak)
+	}
+}
+
+// TestWorkerPoolResponseMetadata ensures the response metadata is recorded
+// with the attempt and kept as the url's last response
+func TestWorkerPoolResponseMetadata(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/old" {
+			http.Redirect(w, r, "/new", http.StatusMovedPermanently)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Server", "test-server")
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Add("X-Cache", "miss")
+		w.Header().Add("X-Cache", "stored")
+		w.Write([]byte("<html></html>"))
+	}))
+	defer server.Close()
+
+	s := store.NewMemoryStore(store.Config{})
+	wp, err := NewWorkerPool(Config{WorkerPoolSize: 1, RecordHeaders: []string{"etag", "X-Cache", "X-Missing"}}, s, nil)
+	if err != nil {
+		t.Fatalf("could not create worker pool: %v", err)
+	}
+	defer wp.Shutdown()
+
+	wp.AddTask(server.URL + "/old")
+	wp.Wait()
+
+	node, ok := s.Get(server.URL + "/old")
+	if !ok || node.Data.LastResponse == nil {
+		t.Fatalf("expected the url to be stored with its last response")
+	}
+	last := node.Data.LastResponse
+	expectedHeaders := map[string]string{"Etag": `"v1"`, "X-Cache": "miss, stored"}
+	if last.StatusCode != http.StatusOK || last.Bytes != 13 || last.ContentType != "text/html; charset=utf-8" ||
+		last.Server != "test-server" || last.FinalURL != server.URL+"/new" || fmt.Sprint(last.Headers) != fmt.Sprint(expectedHeaders) {
+		t.Errorf("unexpected response metadata %+v", last)
+	}
+}
+
+// TestFingerprint ensures the text hash ignores markup and whitespace while
+// the raw hash does not
+func TestFingerprint(t *testing.T) {
+	sums := func(contentType string, chunks ...string) (string, string) {
+		fp := newFingerprint(contentType)
+		for _, chunk := range chunks {
+			fp.Write([]byte(chunk))
+		}
+		return fp.sums()
+	}
+
+	raw, text := sums("text/html; charset=utf-8", "<p>Hello   <b>wor", "ld</b></p>\n")
+	otherRaw, otherText := sums("text/html", "<div class=\"x\">\n  Hello\n<span>", "world</span></div>")
+	if raw == otherRaw || text != otherText {
+		t.Errorf("expected different raw hashes but the same text hash, got %s %s and %s %s", raw, text, otherRaw, otherText)
+	}
+
+	if _, changedText := sums("text/html", "<p>Hello there world</p>"); changedText == text {
+		t.Errorf("expected a text change to change the text hash")
+	}
+	if _, binaryText := sums("image/png", "\x89PNG"); binaryText != "" {
+		t.Errorf("expected no text hash for binary content, got %s", binaryText)
+	}
+}
+
+// TestWorkerPoolArchive ensures successful bodies are archived and linked to
+// their attempt while failed ones aren't
+func TestWorkerPoolArchive(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/broken" {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("error page"))
+			return
+		}
+		w.Write([]byte("archived body"))
+	}))
+	defer server.Close()
+
+	blobs, err := archive.Open(archive.Config{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("could not open archive: %v", err)
+	}
+	s := store.NewMemoryStore(store.Config{})
+	wp, err := NewWorkerPool(Config{WorkerPoolSize: 1}, s, blobs)
+	if err != nil {
+		t.Fatalf("could not create worker pool: %v", err)
+	}
+	defer wp.Shutdown()
+
+	wp.AddTask(server.URL + "/ok")
+	wp.AddTask(server.URL + "/ok")
+	s.Update(server.URL+"/broken", store.Attempt{Success: true})
+	wp.AddTask(server.URL + "/broken")
+	wp.Wait()
+
+	ok, _ := s.Get(server.URL + "/ok")
+	attempts := ok.Data.History.Attempts()
+	if len(attempts) != 2 || attempts[1].Blob == "" || attempts[1].Blob != attempts[1].SHA256 || attempts[0].Blob != attempts[1].Blob {
+		t.Fatalf("expected both downloads to link to the same blob, got %+v", attempts)
+	}
+	if !blobs.Has(attempts[1].Blob) {
+		t.Errorf("expected blob %s to be archived", attempts[1].Blob)
+	}
+
+	broken, _ := s.Get(server.URL + "/broken")
+	if broken.Data.LastResponse.Blob != "" {
+		t.Errorf("expected the failed download not to be archived, got %+v", broken.Data.LastResponse)
+	}
+}
+
+// TestWorkerPoolConditional ensures refetches send the validators of the
+// last body and record a 304 as a successful not modified download
+func TestWorkerPoolConditional(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	tests := []struct {
+		name        string
+		conditional bool
+		notModified int
+	}{
+		{name: "enabled", conditional: true, notModified: 1},
+		{name: "disabled", conditional: false, notModified: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var conditions []string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				conditions = append(conditions, r.Header.Get("If-None-Match")+"|"+r.Header.Get("If-Modified-Since"))
+				mu.Unlock()
+				w.Header().Set("ETag", `"v1"`)
+				w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+				if r.Header.Get("If-None-Match") == `"v1"` {
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+				w.Write([]byte("body"))
+			}))
+			defer server.Close()
+
+			s := store.NewMemoryStore(store.Config{})
+			wp, err := NewWorkerPool(Config{WorkerPoolSize: 1, ConditionalRequests: tt.conditional}, s, nil)
+			if err != nil {
+				t.Fatalf("could not create worker pool: %v", err)
+			}
+			defer wp.Shutdown()
+
+			wp.AddTask(server.URL)
+			wp.Wait()
+			wp.AddTask(server.URL)
+			wp.Wait()
+
+			node, _ := s.Get(server.URL)
+			data := node.Data
+			if data.Successes != 2 || data.NotModified != tt.notModified || data.ChangeCount != 0 || data.ETag != `"v1"` {
+				t.Errorf("unexpected data %+v", data)
+			}
+			if tt.conditional && data.LastResponse.Outcome != store.OutcomeNotModified {
+				t.Errorf("expected the last response to be not modified, got %+v", data.LastResponse)
+			}
+
+			expected := []string{"|", "|"}
+			if tt.conditional {
+				expected[1] = `"v1"|Mon, 02 Jan 2006 15:04:05 GMT`
+			}
+			if fmt.Sprint(conditions) != fmt.Sprint(expected) {
+				t.Errorf("expected conditions %q, got %q", expected, conditions)
+			}
+		})
+	}
+}
+
+// TestWorkerPoolTiming ensures the duration of a download covers the body
+// and is broken down into the wait for the first byte and the transfer
+func TestWorkerPoolTiming(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		w.Write([]byte("first"))
+		w.(http.Flusher).Flush()
+		time.Sleep(50 * time.Millisecond)
+		w.Write([]byte("second"))
+	}))
+	defer server.Close()
+
+	s := store.NewMemoryStore(store.Config{})
+	wp, err := NewWorkerPool(Config{WorkerPoolSize: 1}, s, nil)
+	if err != nil {
+		t.Fatalf("could not create worker pool: %v", err)
+	}
+	defer wp.Shutdown()
+
+	wp.AddTask(server.URL)
+	wp.Wait()
+
+	node, ok := s.Get(server.URL)
+	if !ok || node.Data.LastResponse == nil || node.Data.LastResponse.Timing == nil {
+		t.Fatalf("expected the download to be stored with its timing")
+	}
+	last := node.Data.LastResponse
+	timing := last.Timing
+	if timing.TTFBMs < 40 || timing.TransferMs < 40 || timing.TotalMs < 100 || last.DurationMs != timing.TotalMs {
+		t.Errorf("expected the wait and transfer to be timed separately, got %dms and %+v", last.DurationMs, timing)
+	}
+	if latency := node.Data.History.Stats(); latency.Phases == nil || latency.Phases.Samples != 1 {
+		t.Errorf("expected phase stats for the download, got %+v", latency.Phases)
+	}
+}
+
+// TestWorkerPoolRedirects ensures every hop of a redirect chain is recorded
+// and that hops to another domain or from https to http are flagged
+func TestWorkerPoolRedirects(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	final := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("final"))
+	}))
+	defer final.Close()
+	// localhost is another registered domain than the 127.0.0.1 of the servers
+	elsewhere := strings.Replace(final.URL, "127.0.0.1", "localhost", 1)
+
+	redirector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/start":
+			http.Redirect(w, r, "/next", http.StatusFound)
+		case "/next":
+			http.Redirect(w, r, elsewhere+"/final", http.StatusMovedPermanently)
+		}
+	}))
+	defer redirector.Close()
+
+	secure := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, final.URL+"/insecure", http.StatusFound)
+	}))
+	defer secure.Close()
+
+	s := store.NewMemoryStore(store.Config{})
+	wp, err := NewWorkerPool(Config{WorkerPoolSize: 1, Client: ClientConfig{InsecureSkipVerify: true}}, s, nil)
+	if err != nil {
+		t.Fatalf("could not create worker pool: %v", err)
+	}
+	defer wp.Shutdown()
+
+	wp.AddTask(redirector.URL + "/start")
+	wp.AddTask(secure.URL)
+	wp.AddTask(final.URL)
+	wp.Wait()
+
+	node, _ := s.Get(redirector.URL + "/start")
+	hops := node.Data.LastResponse.Redirects
+	if len(hops) != 2 || hops[0].URL != redirector.URL+"/start" || hops[0].StatusCode != http.StatusFound ||
+		hops[0].Location != redirector.URL+"/next" || hops[0].CrossDomain ||
+		hops[1].StatusCode != http.StatusMovedPermanently || !hops[1].CrossDomain || hops[1].Downgrade {
+		t.Errorf("unexpected redirect chain %+v", hops)
+	}
+	if data := node.Data; data.Redirected != 1 || data.CrossDomainRedirects != 1 || data.DowngradeRedirects != 0 {
+		t.Errorf("unexpected redirect counters %+v", data)
+	}
+
+	node, _ = s.Get(secure.URL)
+	if hops := node.Data.LastResponse.Redirects; len(hops) != 1 || !hops[0].Downgrade || hops[0].CrossDomain {
+		t.Errorf("expected a downgrade, got %+v", hops)
+	}
+	if node.Data.DowngradeRedirects != 1 {
+		t.Errorf("expected the downgrade to be counted, got %+v", node.Data)
+	}
+
+	node, _ = s.Get(final.URL)
+	if node.Data.LastResponse.Redirects != nil || node.Data.Redirected != 0 {
+		t.Errorf("expected no redirects, got %+v", node.Data)
+	}
+}
+
+// TestWorkerPoolBodyLimits ensures downloads going over the body limits are
+// aborted, recording how much was read, while those within them succeed
+func TestWorkerPoolBodyLimits(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/big":
+			w.Write(make([]byte, 10000))
+		case "/exact":
+			w.Write(make([]byte, 4096))
+		case "/slow-headers":
+			time.Sleep(1500 * time.Millisecond)
+			w.Write([]byte("late"))
+		case "/stall":
+			w.Write([]byte("start"))
+			w.(http.Flusher).Flush()
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name    string
+		path    string
+		config  BodyConfig
+		aborted bool
+		bytes   int64
+	}{
+		{name: "too big", path: "/big", config: BodyConfig{MaxBytes: 4096}, aborted: true, bytes: 4096},
+		{name: "exactly the limit", path: "/exact", config: BodyConfig{MaxBytes: 4096}, bytes: 4096},
+		{name: "too long", path: "/stall", config: BodyConfig{MaxDurationSeconds: 1}, aborted: true, bytes: 5},
+		{name: "too slow", path: "/stall", config: BodyConfig{MinBytesPerSecond: 100, ThroughputWindowSeconds: 1}, aborted: true, bytes: 5},
+		{name: "slow headers", path: "/slow-headers", config: BodyConfig{MinBytesPerSecond: 10, ThroughputWindowSeconds: 1}, bytes: 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := store.NewMemoryStore(store.Config{})
+			wp, err := NewWorkerPool(Config{WorkerPoolSize: 1, Body: tt.config, Retry: RetryConfig{MaxAttempts: 3, RetryOnTimeout: true}}, s, nil)
+			if err != nil {
+				t.Fatalf("could not create worker pool: %v", err)
+			}
+			defer wp.Shutdown()
+
+			started := time.Now()
+			job, _ := wp.Submit(context.Background(), server.URL+tt.path, "")
+			wp.Wait()
+			if elapsed := time.Since(started); elapsed > 3*time.Second {
+				t.Errorf("expected the download to be cut short, took %s", elapsed)
+			}
+
+			status := JobSucceeded
+			var attempts []store.Attempt
+			if tt.aborted {
+				// An aborted first download rejects the url like any other
+				// failure
+				status = JobAborted
+				if _, ok := s.Get(server.URL + tt.path); ok {
+					t.Errorf("expected the url not to be stored")
+				}
+				rejected, ok := s.GetRejected(server.URL + tt.path)
+				if !ok || rejected.Outcome != store.OutcomeAborted || rejected.Tries != 1 || !strings.HasPrefix(rejected.Reason, "aborted: ") {
+					t.Fatalf("expected an aborted rejection, got %+v", rejected)
+				}
+				attempts = rejected.Attempts
+			} else {
+				node, ok := s.Get(server.URL + tt.path)
+				if !ok {
+					t.Fatalf("expected the url to be stored")
+				}
+				attempts = node.Data.History.Attempts()
+			}
+			last := attempts[len(attempts)-1]
+			if len(attempts) != 1 || last.Aborted() != tt.aborted || last.Bytes != tt.bytes || last.Success == tt.aborted {
+				t.Errorf("unexpected attempts %+v", attempts)
+			}
+
+			if job, _ := wp.Job(job.ID); job.Status != status {
+				t.Errorf("expected job status %s, got %s", status, job.Status)
+			}
+		})
+	}
+
+	// A max duration the client's timeout would cut short first is refused
+	s := store.NewMemoryStore(store.Config{})
+	if _, err := NewWorkerPool(Config{Body: BodyConfig{MaxDurationSeconds: 60}}, s, nil); err == nil {
+		t.Errorf("expected a max duration as long as the default timeout to be an error")
+	}
+	if _, err := NewWorkerPool(Config{Body: BodyConfig{MaxDurationSeconds: 30}, Client: ClientConfig{TimeoutSeconds: 10}}, s, nil); err == nil {
+		t.Errorf("expected a max duration longer than the timeout to be an error")
+	}
+}
+
+// TestGuard ensures the ssrf guard refuses internal addresses, schemes and
+// ports that aren't allowed, unless they are on the allowlist
+func TestGuard(t *testing.T) {
+	guard, err := NewGuard(GuardConfig{
+		Enabled:      true,
+		BlockedCIDRs: []string{"203.0.113.0/24"},
+		AllowedCIDRs: []string{"10.1.0.0/16"},
+		AllowedHosts: []string{".internal.test"},
+	})
+	if err != nil {
+		t.Fatalf("could not create guard: %v", err)
+	}
+
+	tests := []struct {
+		url     string
+		allowed bool
+	}{
+		{url: "http://93.184.216.34/", allowed: true},
+		{url: "https://93.184.216.34:443/", allowed: true},
+		{url: "http://127.0.0.1/"},
+		{url: "http://[::1]/"},
+		{url: "http://[::ffff:127.0.0.1]/"},
+		{url: "http://[64:ff9b::7f00:1]/"},
+		{url: "http://[64:ff9b::5db8:d822]/", allowed: true},
+		{url: "http://[64:ff9b:1::a00:1]/"},
+		{url: "http://[2002:a00:1::1]/"},
+		{url: "http://[2002:5db8:d822::1]/", allowed: true},
+		{url: "http://[fec0::1]/"},
+		{url: "http://169.254.169.254/latest/meta-data/"},
+		{url: "http://10.0.0.1/"},
+		{url: "http://192.168.1.1/"},
+		{url: "http://100.64.0.1/"},
+		{url: "http://0.0.0.0/"},
+		{url: "http://203.0.113.5/"},
+		{url: "ftp://93.184.216.34/"},
+		{url: "http://93.184.216.34:22/"},
+		{url: "http://10.1.2.3/", allowed: true},
+		{url: "http://api.internal.test/", allowed: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			err := guard.CheckURL(context.Background(), tt.url)
+			var forbiddenErr *forbiddenError
+			if tt.allowed && err != nil {
+				t.Errorf("expected %s to be allowed, got %v", tt.url, err)
+			}
+			if !tt.allowed && !errors.As(err, &forbiddenErr) {
+				t.Errorf("expected %s to be forbidden, got %v", tt.url, err)
+			}
+		})
+	}
+
+	if guard, _ := NewGuard(GuardConfig{}); guard != nil {
+		t.Errorf("expected no guard when disabled")
+	}
+	if _, err := NewGuard(GuardConfig{Enabled: true, BlockedCIDRs: []string{"nonsense"}}); err == nil {
+		t.Errorf("expected an invalid cidr to be an error")
+	}
+}
+
+// TestWorkerPoolGuard ensures the guard is applied when dialling and to
+// every redirect, not only to the URL that was submitted
+func TestWorkerPoolGuard(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/to-localhost":
+			http.Redirect(w, r, strings.Replace(r.Host, "127.0.0.1", "http://localhost", 1)+"/", http.StatusFound)
+		case "/to-private":
+			http.Redirect(w, r, "http://10.0.0.1/", http.StatusFound)
+		default:
+			w.Write([]byte("ok"))
+		}
+	}))
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+	port, _ := strconv.Atoi(serverURL.Port())
+
+	tests := []struct {
+		name    string
+		guard   GuardConfig
+		path    string
+		success bool
+	}{
+		{name: "loopback refused when dialling", guard: GuardConfig{Enabled: true, AllowedPorts: []int{port}}, path: "/"},
+		{name: "allowlisted host", guard: GuardConfig{Enabled: true, AllowedPorts: []int{port}, AllowedHosts: []string{"127.0.0.1"}}, path: "/", success: true},
+		{name: "redirect to a host resolving to loopback", guard: GuardConfig{Enabled: true, AllowedPorts: []int{port}, AllowedHosts: []string{"127.0.0.1"}}, path: "/to-localhost"},
+		{name: "redirect to a private address", guard: GuardConfig{Enabled: true, AllowedPorts: []int{port, 80}, AllowedHosts: []string{"127.0.0.1"}}, path: "/to-private"},
+		{name: "guard disabled", path: "/to-localhost", success: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := store.NewMemoryStore(store.Config{})
+			wp, err := NewWorkerPool(Config{WorkerPoolSize: 1, SSRF: tt.guard, Retry: RetryConfig{MaxAttempts: 3, RetryOnConnectionError: true}}, s, nil)
+			if err != nil {
+				t.Fatalf("could not create worker pool: %v", err)
+			}
+			defer wp.Shutdown()
+
+			job, _ := wp.Submit(context.Background(), server.URL+tt.path, "")
+			wp.Wait()
+
+			job, _ = wp.Job(job.ID)
+			if tt.success != (job.Status == JobSucceeded) {
+				t.Fatalf("expected success %v, got %+v", tt.success, job)
+			}
+			if !tt.success && (job.Attempts != 1 || !strings.Contains(job.Error, "forbidden by ssrf guard")) {
+				t.Errorf("expected a single try refused by the guard, got %+v", job)
+			}
+			// A redirect refused by the guard isn't part of the chain
+			if r, ok := s.GetRejected(server.URL + tt.path); ok && tt.path == "/to-private" && len(r.Attempts[0].Redirects) != 0 {
+				t.Errorf("expected the refused redirect not to be recorded, got %+v", r.Attempts[0].Redirects)
+			}
+		})
+	}
+}
+
+// TestWorkerPoolGuardProxy ensures downloads sent through a proxy are checked
+// against the guard before the request, as only the proxy is dialled
+func TestWorkerPoolGuardProxy(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("proxied"))
+	}))
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+	port, _ := strconv.Atoi(proxyURL.Port())
+
+	tests := []struct {
+		name    string
+		hosts   []string
+		success bool
+	}{
+		{name: "host resolving to loopback", hosts: []string{"127.0.0.1"}},
+		{name: "allowlisted host", hosts: []string{"127.0.0.1", "localhost"}, success: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := store.NewMemoryStore(store.Config{})
+			guard := GuardConfig{Enabled: true, AllowedPorts: []int{port, 80}, AllowedHosts: tt.hosts}
+			wp, err := NewWorkerPool(Config{WorkerPoolSize: 1, SSRF: guard, Client: ClientConfig{ProxyURL: proxy.URL}}, s, nil)
+			if err != nil {
+				t.Fatalf("could not create worker pool: %v", err)
+			}
+			defer wp.Shutdown()
+
+			job, _ := wp.Submit(context.Background(), "http://localhost/", "")
+			wp.Wait()
+
+			job, _ = wp.Job(job.ID)
+			if tt.success != (job.Status == JobSucceeded) {
+				t.Fatalf("expected success %v, got %+v", tt.success, job)
+			}
+			if !tt.success && !strings.Contains(job.Error, "forbidden by ssrf guard") {
+				t.Errorf("expected the guard to refuse the download, got %+v", job)
+			}
 		})
 	}
 }
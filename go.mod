@@ -2,6 +2,4 @@ module spamhaus
 
 go 1.22.2
 
-require (
-	gopkg.in/yaml.v2 v2.4.0 // indirect
-)
+require gopkg.in/yaml.v2 v2.4.0
@@ -0,0 +1,40 @@
+package store
+
+import "time"
+
+const defaultChangeHistorySize = 50
+
+// Change is a point in a URL's timeline where its content was first seen or
+// seen to differ from the download before
+type Change struct {
+	At       time.Time `json:"at"`
+	SHA256   string    `json:"sha256"`
+	TextHash string    `json:"text_hash,omitempty"`
+	// TextChanged is false when only the markup or whitespace changed
+	TextChanged bool `json:"text_changed"`
+}
+
+// trackChange compares the fingerprint of a successful download with the
+// last one seen and adds it to the timeline if the content differs. Only
+// the newest size changes are kept.
+func (d *URLData) trackChange(attempt Attempt, at time.Time, size int) {
+	if !attempt.Success || attempt.SHA256 == "" {
+		return
+	}
+
+	change := Change{At: at, SHA256: attempt.SHA256, TextHash: attempt.TextHash}
+	if len(d.Changes) > 0 {
+		last := d.Changes[len(d.Changes)-1]
+		if last.SHA256 == attempt.SHA256 {
+			return
+		}
+		change.TextChanged = last.TextHash != attempt.TextHash
+		d.ChangeCount++
+		d.LastChanged = at
+	}
+
+	if len(d.Changes) >= size {
+		d.Changes = append(d.Changes[:0], d.Changes[len(d.Changes)-size+1:]...)
+	}
+	d.Changes = append(d.Changes, change)
+}
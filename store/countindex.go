@@ -0,0 +1,233 @@
+package store
+
+import "math/rand"
+
+// countBucket holds every node submitted the same number of times, ordered by
+// ID, which breaks ties on the count, so a page can be read off it without
+// sorting the bucket.
+type countBucket struct {
+	count int
+	size  int
+	byID  *idTree
+	// lower and higher are the neighbouring buckets, the ones with the next
+	// smaller and larger counts
+	lower  *countBucket
+	higher *countBucket
+}
+
+// countIndex keeps the nodes in buckets by submission count, ordered from the
+// lowest count to the highest, so ranking by count can start at the top
+// instead of sorting the whole store. A submission moves a node to the next
+// bucket up, which is either the neighbouring one or a new one next to it,
+// so keeping the index up to date takes O(log n), the cost of moving the
+// node between the buckets' trees.
+type countIndex struct {
+	lowest  *countBucket
+	highest *countBucket
+}
+
+// add indexes a node under its current count
+func (x *countIndex) add(node *URLNode) {
+	x.insert(node, x.lowest)
+}
+
+// increment moves a node whose count just went up by one
+func (x *countIndex) increment(node *URLNode) {
+	near := node.bucket
+	x.remove(node)
+	if near.size == 0 {
+		// The node was alone in its bucket, which has been dropped, but the
+		// bucket below it is still in the index
+		near = near.lower
+	}
+	x.insert(node, near)
+}
+
+// insert puts the node in the bucket for its count, searching up from near,
+// which has to have a count no higher than the node's, or from the lowest
+// bucket if near is nil
+func (x *countIndex) insert(node *URLNode, near *countBucket) {
+	count := node.Data.Count
+	if near == nil {
+		near = x.lowest
+	}
+
+	// Find the highest bucket at or below count
+	var below *countBucket
+	for b := near; b != nil && b.count <= count; b = b.higher {
+		below = b
+	}
+
+	bucket := below
+	if bucket == nil || bucket.count != count {
+		bucket = &countBucket{count: count, lower: below}
+		if below != nil {
+			bucket.higher, below.higher = below.higher, bucket
+		} else {
+			bucket.higher, x.lowest = x.lowest, bucket
+		}
+		if bucket.higher != nil {
+			bucket.higher.lower = bucket
+		} else {
+			x.highest = bucket
+		}
+	}
+
+	bucket.byID = bucket.byID.insert(node, rand.Uint32())
+	bucket.size++
+	node.bucket = bucket
+}
+
+// remove takes the node out of its bucket, dropping the bucket once it is
+// empty
+func (x *countIndex) remove(node *URLNode) {
+	bucket := node.bucket
+	node.bucket = nil
+	bucket.byID = bucket.byID.remove(node)
+	bucket.size--
+	if bucket.size > 0 {
+		return
+	}
+
+	if bucket.lower != nil {
+		bucket.lower.higher = bucket.higher
+	} else {
+		x.lowest = bucket.higher
+	}
+	if bucket.higher != nil {
+		bucket.higher.lower = bucket.lower
+	} else {
+		x.highest = bucket.lower
+	}
+}
+
+// idTree is a treap of nodes ordered by ID, then URL in case two URLs share
+// an ID, and heap ordered by a random priority so it stays balanced, making
+// an insert or remove O(log n)
+type idTree struct {
+	node     *URLNode
+	priority uint32
+	left     *idTree
+	right    *idTree
+}
+
+func idLess(a, b *URLNode) bool {
+	if a.ID != b.ID {
+		return a.ID < b.ID
+	}
+	return a.URL < b.URL
+}
+
+// insert returns the tree with the node added
+func (t *idTree) insert(node *URLNode, priority uint32) *idTree {
+	if t == nil {
+		return &idTree{node: node, priority: priority}
+	}
+	if idLess(node, t.node) {
+		t.left = t.left.insert(node, priority)
+		if t.left.priority > t.priority {
+			t = t.rotateRight()
+		}
+	} else {
+		t.right = t.right.insert(node, priority)
+		if t.right.priority > t.priority {
+			t = t.rotateLeft()
+		}
+	}
+	return t
+}
+
+// remove returns the tree without the node
+func (t *idTree) remove(node *URLNode) *idTree {
+	switch {
+	case t == nil:
+		return nil
+	case t.node != node:
+		if idLess(node, t.node) {
+			t.left = t.left.remove(node)
+		} else {
+			t.right = t.right.remove(node)
+		}
+		return t
+	case t.left == nil:
+		return t.right
+	case t.right == nil:
+		return t.left
+	}
+
+	// Rotate the node down below the child with the higher priority until
+	// it has a side free
+	if t.left.priority > t.right.priority {
+		t = t.rotateRight()
+		t.right = t.right.remove(node)
+	} else {
+		t = t.rotateLeft()
+		t.left = t.left.remove(node)
+	}
+	return t
+}
+
+func (t *idTree) rotateRight() *idTree {
+	l := t.left
+	t.left, l.right = l.right, t
+	return l
+}
+
+func (t *idTree) rotateLeft() *idTree {
+	r := t.right
+	t.right, r.left = r.left, t
+	return r
+}
+
+// ascend calls fn on the nodes with an ID after the given one, in order,
+// until it returns false, which ascend then returns too
+func (t *idTree) ascend(after string, fn func(*URLNode) bool) bool {
+	if t == nil {
+		return true
+	}
+	if t.node.ID > after {
+		if !t.left.ascend(after, fn) || !fn(t.node) {
+			return false
+		}
+	}
+	return t.right.ascend(after, fn)
+}
+
+// filterByCount ranks by lifetime count using the index. Buckets are visited
+// from the top, or the bottom when ascending, until the page is full. A
+// cursor skips the buckets before it and, in its own bucket, the IDs up to
+// it.
+func (s *URLStore) filterByCount(q Query) []*URLNode {
+	nodes := make([]*URLNode, 0, q.Limit)
+
+	bucket, step := s.counts.highest, func(b *countBucket) *countBucket { return b.lower }
+	if q.Ascending {
+		bucket, step = s.counts.lowest, func(b *countBucket) *countBucket { return b.higher }
+	}
+
+	for ; bucket != nil && len(nodes) < q.Limit; bucket = step(bucket) {
+		if !q.Ascending && bucket.count < q.MinCount {
+			// Every bucket left is lower still
+			break
+		}
+		after := ""
+		if q.After != nil {
+			at := position{key: float64(bucket.count)}
+			if at.key == q.After.Key {
+				after = q.After.ID
+			} else if comesBefore(q, at, q.After.position()) {
+				// The whole bucket was on earlier pages
+				continue
+			}
+		}
+
+		bucket.byID.ascend(after, func(node *URLNode) bool {
+			if q.matches(node) {
+				nodes = append(nodes, node.copy())
+			}
+			return len(nodes) < q.Limit
+		})
+	}
+
+	return nodes
+}
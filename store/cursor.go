@@ -0,0 +1,108 @@
+package store
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Cursor marks the last URL of a page. It is handed to clients as an opaque
+// string and passed back to continue listing after that URL.
+//
+// Listings by submission time are positioned by Seq, which only ever grows as
+// a URL moves to the tail of the list. A URL resubmitted while a client is
+// paging therefore moves ahead of the cursor instead of shifting every later
+// page. Other orders are positioned by the sort key and the URL ID.
+type Cursor struct {
+	SortBy    string        `json:"s"`
+	Ascending bool          `json:"a,omitempty"`
+	Window    time.Duration `json:"w,omitempty"`
+	Key       float64       `json:"k,omitempty"`
+	Seq       uint64        `json:"q,omitempty"`
+	ID        string        `json:"i"`
+}
+
+// position is where a node sits in a listing, comparable with a Cursor
+type position struct {
+	key float64
+	seq uint64
+	id  string
+}
+
+// CursorAfter returns the cursor continuing the query after node
+func CursorAfter(q Query, node *URLNode) Cursor {
+	pos := positionOf(q, node)
+	return Cursor{
+		SortBy:    q.SortBy,
+		Ascending: q.Ascending,
+		Window:    q.Window,
+		Key:       pos.key,
+		Seq:       pos.seq,
+		ID:        pos.id,
+	}
+}
+
+func (c Cursor) Encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// DecodeCursor parses a cursor returned by Encode and checks it was issued
+// for the same ordering as the query it is used with
+func DecodeCursor(encoded string, q Query) (*Cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	var c Cursor
+	if err := json.Unmarshal(data, &c); err != nil || c.ID == "" {
+		return nil, ErrInvalidCursor
+	}
+	if normaliseSort(c.SortBy) != normaliseSort(q.SortBy) || c.Ascending != q.Ascending || c.Window != q.Window {
+		return nil, errors.New("cursor was issued for a different sort order")
+	}
+
+	return &c, nil
+}
+
+func (c *Cursor) position() position {
+	return position{key: c.Key, seq: c.Seq, id: c.ID}
+}
+
+// normaliseSort maps the aliases of list order to a single name
+func normaliseSort(sortBy string) string {
+	if sortBy == "" || sortBy == SortSubmitted {
+		return SortLatest
+	}
+	return sortBy
+}
+
+func positionOf(q Query, node *URLNode) position {
+	if normaliseSort(q.SortBy) == SortLatest {
+		return position{seq: node.seq, id: node.ID}
+	}
+	return position{key: sortKey(q, node), id: node.ID}
+}
+
+// comesBefore reports whether a is listed before b. Ties on the sort key are
+// broken by ID, which never changes, so the order is total and stable.
+func comesBefore(q Query, a, b position) bool {
+	if normaliseSort(q.SortBy) == SortLatest {
+		if q.Ascending {
+			return a.seq < b.seq
+		}
+		return a.seq > b.seq
+	}
+
+	if a.key != b.key {
+		if q.Ascending {
+			return a.key < b.key
+		}
+		return a.key > b.key
+	}
+	return a.id < b.id
+}
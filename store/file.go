@@ -0,0 +1,100 @@
+package store
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// NewFileStore starts a store that is persisted to cfg.DataDir. The last
+// snapshot and any write-ahead log entries written after it are replayed
+// before the store starts serving requests.
+func NewFileStore(cfg Config) (*URLStore, error) {
+	if cfg.DataDir == "" {
+		return nil, fmt.Errorf("store: file backend requires a data_dir")
+	}
+
+	store := newURLStore(cfg)
+	if err := store.recover(cfg); err != nil {
+		return nil, err
+	}
+
+	go store.processRequests()
+	return store, nil
+}
+
+// recover creates the data directory if needed, loads the latest snapshot
+// and replays the write-ahead log on top of it.
+func (s *URLStore) recover(cfg Config) error {
+	if err := os.MkdirAll(cfg.DataDir, 0o755); err != nil {
+		return fmt.Errorf("store: creating data dir %s: %w", cfg.DataDir, err)
+	}
+
+	lastSeq, err := s.loadSnapshot(cfg.DataDir)
+	if err != nil {
+		return fmt.Errorf("store: %w", err)
+	}
+
+	w, err := openWAL(cfg.DataDir, cfg.SyncWrites)
+	if err != nil {
+		return fmt.Errorf("store: %w", err)
+	}
+
+	replayed, err := w.replay(lastSeq, func(entry walEntry) {
+		switch entry.Op {
+		case "update":
+			s.update(entry.URL, entry.Attempt, entry.At)
+		case "promote":
+			if _, ok := s.rejected.lookup(entry.URL); ok {
+				s.promote(entry.URL, entry.At)
+			}
+		}
+	})
+	if err != nil {
+		w.close()
+		return fmt.Errorf("store: replaying wal: %w", err)
+	}
+
+	s.dataDir = cfg.DataDir
+	s.wal = w
+	s.snapshotInterval = time.Duration(cfg.SnapshotIntervalSeconds) * time.Second
+	log.Printf("store: recovered %d urls from %s (%d wal entries replayed)", len(s.data), cfg.DataDir, replayed)
+	return nil
+}
+
+// persist appends a mutation to the write-ahead log before it is applied.
+// Failing to write is logged rather than fatal so the daemon keeps serving.
+func (s *URLStore) persist(entry walEntry) {
+	if s.wal == nil {
+		return
+	}
+	if err := s.wal.append(entry); err != nil {
+		log.Printf("store: %s", err)
+	}
+}
+
+// compact writes a snapshot of the whole store and truncates the write-ahead
+// log it supersedes.
+func (s *URLStore) compact() {
+	if s.wal == nil {
+		return
+	}
+	if err := s.writeSnapshot(s.dataDir, s.wal.seq); err != nil {
+		log.Printf("store: writing snapshot: %s", err)
+		return
+	}
+	if err := s.wal.truncate(); err != nil {
+		log.Printf("store: truncating wal: %s", err)
+	}
+}
+
+func (s *URLStore) close() {
+	if s.wal == nil {
+		return
+	}
+	s.compact()
+	if err := s.wal.close(); err != nil {
+		log.Printf("store: closing wal: %s", err)
+	}
+}
@@ -0,0 +1,257 @@
+package store
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+)
+
+const defaultHistorySize = 20
+
+// Outcomes of attempts that were neither a plain success nor a failure
+const (
+	// OutcomeBlockedRobots means robots.txt disallows the URL so it was not
+	// downloaded
+	OutcomeBlockedRobots = "blocked_robots"
+	// OutcomeNotModified means a conditional request was answered with 304
+	// Not Modified, a success without a body
+	OutcomeNotModified = "not_modified"
+	// OutcomeAborted means the download was cut short for going over the
+	// body size, duration or throughput limits, Bytes is what was read
+	OutcomeAborted = "aborted"
+)
+
+// Attempt is a single download of a URL. A submission that is retried is
+// recorded as one attempt per try, all but the last with Retrying set.
+type Attempt struct {
+	At         time.Time `json:"at"`
+	Success    bool      `json:"success"`
+	DurationMs int64     `json:"duration_ms"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Bytes      int64     `json:"bytes"`
+	Error      string    `json:"error,omitempty"`
+
+	// Metadata of the response, only set when there was one. Headers holds
+	// the response headers the downloader was configured to record.
+	ContentType     string            `json:"content_type,omitempty"`
+	ContentEncoding string            `json:"content_encoding,omitempty"`
+	Server          string            `json:"server,omitempty"`
+	FinalURL        string            `json:"final_url,omitempty"`
+	ETag            string            `json:"etag,omitempty"`
+	LastModified    string            `json:"last_modified,omitempty"`
+	Headers         map[string]string `json:"headers,omitempty"`
+
+	// Fingerprints of a successfully downloaded body, TextHash is only set
+	// for text and ignores markup and whitespace
+	SHA256   string `json:"sha256,omitempty"`
+	TextHash string `json:"text_hash,omitempty"`
+	// Blob is the hash the body was archived under, empty if it wasn't
+	Blob string `json:"blob,omitempty"`
+	// Submitted is the form the URL was submitted in when it differs from
+	// its canonical form
+	Submitted string `json:"submitted,omitempty"`
+	// Try numbers the attempts of one submission starting at 1, zero is
+	// treated as a first try
+	Try      int  `json:"try,omitempty"`
+	Retrying bool `json:"retrying,omitempty"`
+	// Refetch is set for downloads the daemon started itself, such as the
+	// batch process's, which don't count as submissions of the URL
+	Refetch bool `json:"refetch,omitempty"`
+	// Outcome is set for attempts that were not simply downloaded or failed
+	Outcome string `json:"outcome,omitempty"`
+	// Timing breaks DurationMs down into phases, nil if no request was made
+	Timing *Timing `json:"timing,omitempty"`
+	// Redirects is the chain of redirects followed, in order, FinalURL is
+	// where the last one led
+	Redirects []Redirect `json:"redirects,omitempty"`
+}
+
+// Redirect is a hop of a redirect chain: URL answered with StatusCode after
+// DurationMs, sending the client on to Location
+type Redirect struct {
+	URL        string `json:"url"`
+	StatusCode int    `json:"status_code"`
+	Location   string `json:"location"`
+	DurationMs int64  `json:"duration_ms"`
+	// CrossDomain is set when Location is on another registered domain and
+	// Downgrade when it moves from https to http
+	CrossDomain bool `json:"cross_domain,omitempty"`
+	Downgrade   bool `json:"downgrade,omitempty"`
+}
+
+// Timing is how long each phase of a download took. Phases that didn't
+// happen, such as DNS and connecting on a reused connection, are zero, and
+// phases repeated for redirects are summed.
+type Timing struct {
+	DNSMs     int64 `json:"dns_ms"`
+	ConnectMs int64 `json:"connect_ms"`
+	TLSMs     int64 `json:"tls_ms"`
+	// TTFBMs is the wait from the request being sent to the first byte of
+	// the response, TransferMs the time from there to the end of the body
+	TTFBMs     int64 `json:"ttfb_ms"`
+	TransferMs int64 `json:"transfer_ms"`
+	TotalMs    int64 `json:"total_ms"`
+}
+
+// Blocked reports whether the URL was not downloaded because robots.txt
+// disallows it
+func (a Attempt) Blocked() bool {
+	return a.Outcome == OutcomeBlockedRobots
+}
+
+// redirectFlags reports whether any hop of the attempt's redirect chain
+// crossed registered domains or downgraded to http
+func (a Attempt) redirectFlags() (crossDomain, downgrade bool) {
+	for _, hop := range a.Redirects {
+		crossDomain = crossDomain || hop.CrossDomain
+		downgrade = downgrade || hop.Downgrade
+	}
+	return crossDomain, downgrade
+}
+
+// Aborted reports whether the download was cut short by a body limit
+func (a Attempt) Aborted() bool {
+	return a.Outcome == OutcomeAborted
+}
+
+// NotModified reports whether the server answered a conditional request
+// saying the body hasn't changed since it was last downloaded
+func (a Attempt) NotModified() bool {
+	return a.Outcome == OutcomeNotModified
+}
+
+// retry reports whether the attempt repeats an earlier one of the same
+// submission
+func (a Attempt) retry() bool {
+	return a.Try > 1
+}
+
+// submission reports whether the attempt is the first try of a download
+// somebody submitted the URL for
+func (a Attempt) submission() bool {
+	return !a.Refetch && !a.retry()
+}
+
+// History is a bounded ring of the most recent download attempts of a URL.
+// Once full, each new attempt overwrites the oldest one.
+type History struct {
+	attempts []Attempt
+	start    int
+}
+
+// add records an attempt, evicting the oldest one if the ring already holds
+// size attempts
+func (h *History) add(a Attempt, size int) {
+	if len(h.attempts) < size {
+		h.attempts = append(h.attempts, a)
+		return
+	}
+
+	h.attempts[h.start] = a
+	h.start = (h.start + 1) % len(h.attempts)
+}
+
+// Attempts returns the recorded attempts from oldest to newest
+func (h *History) Attempts() []Attempt {
+	ordered := make([]Attempt, 0, len(h.attempts))
+	ordered = append(ordered, h.attempts[h.start:]...)
+	return append(ordered, h.attempts[:h.start]...)
+}
+
+func (h *History) Len() int {
+	return len(h.attempts)
+}
+
+func (h *History) copy() History {
+	return History{attempts: h.Attempts()}
+}
+
+func (h History) MarshalJSON() ([]byte, error) {
+	return json.Marshal(h.Attempts())
+}
+
+func (h *History) UnmarshalJSON(data []byte) error {
+	h.start = 0
+	return json.Unmarshal(data, &h.attempts)
+}
+
+// LatencyStats summarises the download times of the successful attempts held
+// in a History
+type LatencyStats struct {
+	Samples int     `json:"samples"`
+	MinMs   int64   `json:"min_ms"`
+	MaxMs   int64   `json:"max_ms"`
+	MeanMs  float64 `json:"mean_ms"`
+	P50Ms   int64   `json:"p50_ms"`
+	P90Ms   int64   `json:"p90_ms"`
+	P99Ms   int64   `json:"p99_ms"`
+	// Phases is the mean time of each phase, over the samples that have
+	// their timing recorded
+	Phases *PhaseStats `json:"phases,omitempty"`
+}
+
+// PhaseStats holds the mean duration of each download phase
+type PhaseStats struct {
+	Samples    int     `json:"samples"`
+	DNSMs      float64 `json:"dns_ms"`
+	ConnectMs  float64 `json:"connect_ms"`
+	TLSMs      float64 `json:"tls_ms"`
+	TTFBMs     float64 `json:"ttfb_ms"`
+	TransferMs float64 `json:"transfer_ms"`
+}
+
+// Stats computes latency statistics over the successful attempts in the
+// history, failed attempts are left out as their duration is meaningless
+func (h *History) Stats() LatencyStats {
+	durations := make([]int64, 0, len(h.attempts))
+	var total int64
+	var phases PhaseStats
+	for _, a := range h.attempts {
+		if !a.Success {
+			continue
+		}
+		durations = append(durations, a.DurationMs)
+		total += a.DurationMs
+		if t := a.Timing; t != nil {
+			phases.Samples++
+			phases.DNSMs += float64(t.DNSMs)
+			phases.ConnectMs += float64(t.ConnectMs)
+			phases.TLSMs += float64(t.TLSMs)
+			phases.TTFBMs += float64(t.TTFBMs)
+			phases.TransferMs += float64(t.TransferMs)
+		}
+	}
+
+	if len(durations) == 0 {
+		return LatencyStats{}
+	}
+
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	stats := LatencyStats{
+		Samples: len(durations),
+		MinMs:   durations[0],
+		MaxMs:   durations[len(durations)-1],
+		MeanMs:  float64(total) / float64(len(durations)),
+		P50Ms:   percentile(durations, 50),
+		P90Ms:   percentile(durations, 90),
+		P99Ms:   percentile(durations, 99),
+	}
+	if n := float64(phases.Samples); n > 0 {
+		phases.DNSMs /= n
+		phases.ConnectMs /= n
+		phases.TLSMs /= n
+		phases.TTFBMs /= n
+		phases.TransferMs /= n
+		stats.Phases = &phases
+	}
+	return stats
+}
+
+// percentile returns the nearest-rank percentile p of sorted
+func percentile(sorted []int64, p int) int64 {
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
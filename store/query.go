@@ -0,0 +1,232 @@
+package store
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Sort orders supported by Filter
+const (
+	SortLatest      = "latest"
+	SortCount       = "count"
+	SortFailures    = "failures"
+	SortSuccessRate = "success_rate"
+	SortLatency     = "latency"
+	SortSubmitted   = "submitted"
+	// SortFetches ranks by downloads, refetches included, and
+	// SortLastFetched by the time of the last one
+	SortFetches     = "fetches"
+	SortLastFetched = "last_fetched"
+)
+
+// Redirect filters supported by Query.Redirect
+const (
+	RedirectAny         = "any"
+	RedirectCrossDomain = "cross_domain"
+	RedirectDowngrade   = "downgrade"
+)
+
+// ValidRedirect reports whether redirect is a filter Query.Redirect
+// understands, the empty string turning it off
+func ValidRedirect(redirect string) bool {
+	switch redirect {
+	case "", RedirectAny, RedirectCrossDomain, RedirectDowngrade:
+		return true
+	}
+	return false
+}
+
+// ValidSort reports whether sortBy is an order Filter understands
+func ValidSort(sortBy string) bool {
+	switch sortBy {
+	case SortLatest, SortCount, SortFailures, SortSuccessRate, SortLatency, SortSubmitted, SortFetches, SortLastFetched:
+		return true
+	}
+	return false
+}
+
+// Query selects and orders the URLs returned by Filter. Zero valued filters
+// are ignored, so an empty Query returns every URL newest first.
+type Query struct {
+	Limit  int
+	SortBy string
+	// Ascending reverses the default, largest or newest first, order
+	Ascending bool
+
+	Host        string
+	MinCount    int
+	FailingOnly bool
+	Since       time.Time
+	Until       time.Time
+	// ChangedSince keeps URLs whose content changed at or after this time
+	ChangedSince time.Time
+	// Redirect keeps URLs that have been redirected at least once, or
+	// with RedirectCrossDomain and RedirectDowngrade in that way
+	Redirect string
+	// Window makes SortCount and MinCount use the submissions over the
+	// window ending at At, rather than ever. It has to be one of the store's
+	// windows, At defaults to the time of the query.
+	Window time.Duration
+	At     time.Time
+
+	// After continues a previous listing from its cursor
+	After *Cursor
+}
+
+// matches reports whether the node passes every filter in the query
+func (q Query) matches(node *URLNode) bool {
+	data := node.Data
+	if q.Host != "" && !strings.EqualFold(node.host, q.Host) {
+		return false
+	}
+	if q.count(data) < q.MinCount {
+		return false
+	}
+	if q.FailingOnly && !data.failing() {
+		return false
+	}
+	if !q.Since.IsZero() && data.LastSubmitted.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && data.LastSubmitted.After(q.Until) {
+		return false
+	}
+	if !q.ChangedSince.IsZero() && data.LastChanged.Before(q.ChangedSince) {
+		return false
+	}
+	switch q.Redirect {
+	case RedirectAny:
+		return data.Redirected > 0
+	case RedirectCrossDomain:
+		return data.CrossDomainRedirects > 0
+	case RedirectDowngrade:
+		return data.DowngradeRedirects > 0
+	}
+	return true
+}
+
+// count returns the submissions of the URL the query ranks and filters by
+func (q Query) count(d *URLData) int {
+	if q.Window == 0 {
+		return d.Count
+	}
+	return d.RecentCount(q.Window, q.At)
+}
+
+// failing reports whether the most recent download of the URL failed, a URL
+// blocked by robots.txt isn't failing as it wasn't downloaded at all
+func (d *URLData) failing() bool {
+	if d.History.Len() == 0 {
+		return d.Failures > 0
+	}
+	attempts := d.History.Attempts()
+	last := attempts[len(attempts)-1]
+	return !last.Success && !last.Blocked()
+}
+
+// SuccessRate is the fraction of downloads of the URL that succeeded
+func (d *URLData) SuccessRate() float64 {
+	total := d.Successes + d.Failures
+	if total == 0 {
+		return 0
+	}
+	return float64(d.Successes) / float64(total)
+}
+
+// sortKey returns the value a node is ranked by for the query's sort order
+func sortKey(q Query, node *URLNode) float64 {
+	data := node.Data
+	switch q.SortBy {
+	case SortCount:
+		return float64(q.count(data))
+	case SortFailures:
+		return float64(data.Failures)
+	case SortSuccessRate:
+		return data.SuccessRate()
+	case SortLatency:
+		return float64(data.LastDownloadMs)
+	case SortFetches:
+		return float64(data.Fetches)
+	case SortLastFetched:
+		return float64(data.LastFetched.UnixMilli())
+	}
+	return 0
+}
+
+func hostOf(rawURL string) string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(parsed.Hostname())
+}
+
+func (s *URLStore) filter(q Query) []*URLNode {
+	if q.Limit <= 0 {
+		return []*URLNode{}
+	}
+	if q.At.IsZero() {
+		q.At = time.Now()
+	}
+
+	// The list is already ordered by submission time, so latest can stop as
+	// soon as it has enough matches
+	if normaliseSort(q.SortBy) == SortLatest {
+		return s.filterByList(q)
+	}
+
+	// Counts are indexed, so ranking by them only visits the top buckets
+	if normaliseSort(q.SortBy) == SortCount && q.Window == 0 {
+		return s.filterByCount(q)
+	}
+
+	// Every other order has to rank the whole store
+	matched := make([]*URLNode, 0)
+	for current := s.tail; current != nil; current = current.Prev {
+		if q.matches(current) && q.isAfterCursor(current) {
+			matched = append(matched, current)
+		}
+	}
+
+	sort.Slice(matched, func(i, j int) bool {
+		return comesBefore(q, positionOf(q, matched[i]), positionOf(q, matched[j]))
+	})
+
+	if len(matched) > q.Limit {
+		matched = matched[:q.Limit]
+	}
+
+	nodes := make([]*URLNode, 0, len(matched))
+	for _, node := range matched {
+		nodes = append(nodes, node.copy())
+	}
+	return nodes
+}
+
+func (s *URLStore) filterByList(q Query) []*URLNode {
+	nodes := make([]*URLNode, 0, q.Limit)
+
+	current, step := s.tail, func(n *URLNode) *URLNode { return n.Prev }
+	if q.Ascending {
+		current, step = s.head, func(n *URLNode) *URLNode { return n.Next }
+	}
+
+	for ; current != nil && len(nodes) < q.Limit; current = step(current) {
+		if q.matches(current) && q.isAfterCursor(current) {
+			nodes = append(nodes, current.copy())
+		}
+	}
+
+	return nodes
+}
+
+// isAfterCursor reports whether the node belongs after the query's cursor,
+// always true when there is no cursor
+func (q Query) isAfterCursor(node *URLNode) bool {
+	if q.After == nil {
+		return true
+	}
+	return comesBefore(q, q.After.position(), positionOf(q, node))
+}
@@ -0,0 +1,162 @@
+package store
+
+import "time"
+
+const (
+	defaultMaxRejected       = 10000
+	defaultRejectedRetention = 7 * 24 * time.Hour
+)
+
+// Rejected is a URL that was discarded because its first download failed.
+// It is kept apart from the stored URLs, with why it failed, so a submitter
+// can find out what happened to it and it can be retried or promoted.
+type Rejected struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+	// Reason is the error of the last try, StatusCode its status, if it got
+	// a response, and Outcome its outcome, such as aborted, if it had one
+	Reason     string `json:"reason"`
+	StatusCode int    `json:"status_code,omitempty"`
+	Outcome    string `json:"outcome,omitempty"`
+	// Rejections counts the submissions of the URL that were discarded and
+	// Tries the downloads they made, retries included
+	Rejections    int       `json:"rejections"`
+	Tries         int       `json:"tries"`
+	FirstRejected time.Time `json:"first_rejected"`
+	LastRejected  time.Time `json:"last_rejected"`
+	// Attempts are the tries of the last rejected submission
+	Attempts []Attempt `json:"attempts"`
+	// Recent counts the rejected submissions over each of the store's
+	// windows, carried over if the URL is promoted
+	Recent []WindowCount `json:"recent,omitempty"`
+
+	prev *Rejected
+	next *Rejected
+}
+
+// copy returns a detached copy of the entry, without its list pointers
+func (r *Rejected) copy() Rejected {
+	c := *r
+	c.Attempts = append([]Attempt(nil), r.Attempts...)
+	c.Recent = copyWindows(r.Recent)
+	c.prev, c.next = nil, nil
+	return c
+}
+
+// rejectedList holds the rejected URLs in a map for lookups plus a doubly
+// linked list ordered from least to most recently rejected. Entries are
+// forgotten once there are more than max of them or they were last rejected
+// longer than retention ago.
+type rejectedList struct {
+	entries   map[string]*Rejected
+	ids       map[string]*Rejected
+	head      *Rejected
+	tail      *Rejected
+	max       int
+	retention time.Duration
+}
+
+func newRejectedList(max int, retention time.Duration) *rejectedList {
+	if max <= 0 {
+		max = defaultMaxRejected
+	}
+	if retention <= 0 {
+		retention = defaultRejectedRetention
+	}
+
+	return &rejectedList{
+		entries:   make(map[string]*Rejected),
+		ids:       make(map[string]*Rejected),
+		max:       max,
+		retention: retention,
+	}
+}
+
+// add records a rejected submission of the URL made of the given tries, the
+// last of which decided it, and returns its entry
+func (l *rejectedList) add(url string, attempts []Attempt, at time.Time) *Rejected {
+	r, exists := l.entries[url]
+	if exists {
+		l.unlink(r)
+	} else {
+		r = &Rejected{ID: URLID(url), URL: url, FirstRejected: at}
+		l.entries[url] = r
+		l.ids[r.ID] = r
+	}
+
+	last := attempts[len(attempts)-1]
+	r.Reason = last.Error
+	r.StatusCode = last.StatusCode
+	r.Outcome = last.Outcome
+	r.Rejections++
+	r.Tries += len(attempts)
+	r.LastRejected = at
+	r.Attempts = attempts
+
+	l.append(r)
+	l.prune(at)
+	return r
+}
+
+// append inserts an entry at the tail of the list
+func (l *rejectedList) append(r *Rejected) {
+	r.prev, r.next = l.tail, nil
+	if l.tail != nil {
+		l.tail.next = r
+	} else {
+		l.head = r
+	}
+	l.tail = r
+}
+
+func (l *rejectedList) unlink(r *Rejected) {
+	if r.prev != nil {
+		r.prev.next = r.next
+	} else {
+		l.head = r.next
+	}
+	if r.next != nil {
+		r.next.prev = r.prev
+	} else {
+		l.tail = r.prev
+	}
+}
+
+// remove forgets the URL, returning its entry if it had one
+func (l *rejectedList) remove(url string) (*Rejected, bool) {
+	r, exists := l.entries[url]
+	if !exists {
+		return nil, false
+	}
+	l.unlink(r)
+	delete(l.entries, url)
+	delete(l.ids, r.ID)
+	return r, true
+}
+
+// prune drops entries, least recently rejected first, that are past their
+// retention or over the limit
+func (l *rejectedList) prune(now time.Time) {
+	for l.head != nil && (len(l.entries) > l.max || now.Sub(l.head.LastRejected) > l.retention) {
+		l.remove(l.head.URL)
+	}
+}
+
+// lookup finds an entry by its URL or its ID
+func (l *rejectedList) lookup(urlOrID string) (*Rejected, bool) {
+	r, exists := l.entries[urlOrID]
+	if !exists {
+		r, exists = l.ids[urlOrID]
+	}
+	return r, exists
+}
+
+// list returns copies of up to limit entries, the most recently rejected
+// first. A limit of 0 or less returns every entry.
+func (l *rejectedList) list(limit int) []Rejected {
+	result := []Rejected{}
+	for r := l.tail; r != nil && (limit <= 0 || len(result) < limit); r = r.prev {
+		result = append(result, r.copy())
+	}
+	return result
+}
@@ -0,0 +1,120 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const snapshotFileName = "snapshot.json"
+
+// snapshot is the compacted on-disk form of the store. URLs are kept in list
+// order, oldest first, so that "latest" ordering survives a restart. So are
+// the rejected URLs. Pending holds the failed tries of new URLs still being
+// retried, which decide whether they are kept once the retries are over.
+type snapshot struct {
+	LastSeq  uint64               `json:"last_seq"`
+	ListSeq  uint64               `json:"list_seq"`
+	TakenAt  time.Time            `json:"taken_at"`
+	URLs     []snapshotEntry      `json:"urls"`
+	Rejected []Rejected           `json:"rejected,omitempty"`
+	Pending  map[string][]Attempt `json:"pending,omitempty"`
+}
+
+type snapshotEntry struct {
+	URL  string  `json:"url"`
+	Seq  uint64  `json:"seq"`
+	Data URLData `json:"data"`
+}
+
+// writeSnapshot writes the store to dir atomically by writing a temporary
+// file and renaming it over the previous snapshot.
+func (s *URLStore) writeSnapshot(dir string, lastSeq uint64) error {
+	snap := snapshot{
+		LastSeq: lastSeq,
+		ListSeq: s.seq,
+		TakenAt: time.Now(),
+		URLs:    make([]snapshotEntry, 0, len(s.data)),
+	}
+	for node := s.head; node != nil; node = node.Next {
+		snap.URLs = append(snap.URLs, snapshotEntry{URL: node.URL, Seq: node.seq, Data: *node.Data})
+	}
+	for r := s.rejected.head; r != nil; r = r.next {
+		snap.Rejected = append(snap.Rejected, r.copy())
+	}
+	if len(s.pending) > 0 {
+		snap.Pending = make(map[string][]Attempt, len(s.pending))
+		for url, attempts := range s.pending {
+			snap.Pending[url] = append([]Attempt(nil), attempts...)
+		}
+	}
+
+	tmp, err := os.CreateTemp(dir, snapshotFileName+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("creating snapshot: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := json.NewEncoder(tmp).Encode(snap); err != nil {
+		tmp.Close()
+		return fmt.Errorf("encoding snapshot: %w", err)
+	}
+	if err := errors.Join(tmp.Sync(), tmp.Close()); err != nil {
+		return fmt.Errorf("writing snapshot: %w", err)
+	}
+
+	return os.Rename(tmp.Name(), filepath.Join(dir, snapshotFileName))
+}
+
+// loadSnapshot restores the store from the snapshot in dir, returning the
+// sequence number of the last wal entry it covers. A missing snapshot is not
+// an error.
+func (s *URLStore) loadSnapshot(dir string) (uint64, error) {
+	f, err := os.Open(filepath.Join(dir, snapshotFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("opening snapshot: %w", err)
+	}
+	defer f.Close()
+
+	var snap snapshot
+	if err := json.NewDecoder(f).Decode(&snap); err != nil {
+		return 0, fmt.Errorf("decoding snapshot: %w", err)
+	}
+
+	for _, entry := range snap.URLs {
+		data := entry.Data
+		// Trim histories written with a larger history_size or
+		// change_history_size
+		if attempts := data.History.Attempts(); len(attempts) > s.historySize {
+			data.History = History{attempts: attempts[len(attempts)-s.historySize:]}
+		}
+		if len(data.Changes) > s.changeHistorySize {
+			data.Changes = data.Changes[len(data.Changes)-s.changeHistorySize:]
+		}
+		data.Recent = s.keepWindows(data.Recent)
+		node := &URLNode{URL: entry.URL, Data: &data}
+		s.append(node)
+		node.seq = entry.Seq
+	}
+	s.seq = snap.ListSeq
+
+	for _, r := range snap.Rejected {
+		entry := r
+		entry.ID = URLID(entry.URL)
+		entry.Recent = s.keepWindows(entry.Recent)
+		s.rejected.entries[entry.URL] = &entry
+		s.rejected.ids[entry.ID] = &entry
+		s.rejected.append(&entry)
+	}
+	for url, attempts := range snap.Pending {
+		s.pending[url] = attempts
+	}
+
+	return snap.LastSeq, nil
+}
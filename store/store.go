@@ -1,109 +1,395 @@
 package store
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"log"
 	_ "net/http/pprof"
-	"sort"
+	"slices"
 	"time"
 )
 
-var (
-	Requests = make(chan Request)
-	finished = make(chan struct{})
-)
+// maxSubmittedForms bounds how many submitted forms are kept per URL
+const maxSubmittedForms = 10
 
 type Request struct {
 	Method   string
 	URL      string
-	SortBy   string
+	Query    Query
 	Response chan Response
-	TimeMs   int64
-	Number   int
-	Success  bool
+	Attempt  Attempt
 }
 
 type Response struct {
 	Output interface{}
 }
 
+// URLData is everything the store knows about a URL. Count and
+// LastSubmitted only cover submissions, Fetches and LastFetched every
+// download whether it was submitted or a refetch, and the outcome counters
+// every try.
 type URLData struct {
-	LastDownloadMs int64
-	Count          int
-	Successes      int
-	Failures       int
-	LastSubmitted  time.Time
+	LastDownloadMs int64     `json:"last_download_ms"`
+	Count          int       `json:"count"`
+	Fetches        int       `json:"fetches"`
+	Successes      int       `json:"successes"`
+	Failures       int       `json:"failures"`
+	Blocked        int       `json:"blocked"`
+	NotModified    int       `json:"not_modified"`
+	Aborted        int       `json:"aborted"`
+	LastSubmitted  time.Time `json:"last_submitted"`
+	LastFetched    time.Time `json:"last_fetched,omitempty"`
+	History        History   `json:"history"`
+	// Recent counts the submissions over each of the store's windows
+	Recent []WindowCount `json:"recent,omitempty"`
+	// SubmittedAs holds the forms the URL was submitted in other than its
+	// canonical one, the most recently seen last
+	SubmittedAs []string `json:"submitted_as,omitempty"`
+	// LastResponse is the latest attempt that got a response, kept apart from
+	// the history so it survives a run of connection failures
+	LastResponse *Attempt `json:"last_response,omitempty"`
+	// ETag and LastModified are the validators of the body last downloaded,
+	// sent back on refetches so an unchanged body isn't downloaded again
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+
+	// Redirected counts the downloads that followed redirects, and of those
+	// the ones that crossed registered domains or downgraded https to http
+	Redirected           int `json:"redirected"`
+	CrossDomainRedirects int `json:"cross_domain_redirects"`
+	DowngradeRedirects   int `json:"downgrade_redirects"`
+
+	// Changes is the timeline of content fingerprints, starting with the
+	// first one seen. ChangeCount and LastChanged only count real changes.
+	Changes     []Change  `json:"changes,omitempty"`
+	ChangeCount int       `json:"change_count"`
+	LastChanged time.Time `json:"last_changed,omitempty"`
+}
+
+// copy returns a deep copy of the data that is safe to hand out of the store
+// goroutine
+func (d *URLData) copy() *URLData {
+	c := *d
+	c.History = d.History.copy()
+	c.Changes = append([]Change(nil), d.Changes...)
+	c.SubmittedAs = append([]string(nil), d.SubmittedAs...)
+	c.Recent = copyWindows(d.Recent)
+	if d.LastResponse != nil {
+		last := *d.LastResponse
+		c.LastResponse = &last
+	}
+	return &c
+}
+
+// record adds an attempt to the URL's history, counts the download it
+// belongs to, keeps it as the last response if it got one, counts its
+// redirects, remembers the validators of the body and tracks whether the
+// content changed
+func (s *URLStore) record(d *URLData, attempt Attempt, at time.Time) {
+	d.History.add(attempt, s.historySize)
+	// A URL blocked by robots.txt wasn't fetched, and the retries of a
+	// download are the same fetch
+	if !attempt.Blocked() {
+		d.LastFetched = at
+		if !attempt.retry() {
+			d.Fetches++
+		}
+	}
+	if attempt.Submitted != "" {
+		d.addSubmittedAs(attempt.Submitted)
+	}
+	if attempt.StatusCode != 0 {
+		d.LastResponse = &attempt
+	}
+	if len(attempt.Redirects) > 0 {
+		d.Redirected++
+		crossDomain, downgrade := attempt.redirectFlags()
+		if crossDomain {
+			d.CrossDomainRedirects++
+		}
+		if downgrade {
+			d.DowngradeRedirects++
+		}
+	}
+	switch {
+	case attempt.NotModified():
+		// The server may send fresh validators for the same body
+		if attempt.ETag != "" {
+			d.ETag = attempt.ETag
+		}
+		if attempt.LastModified != "" {
+			d.LastModified = attempt.LastModified
+		}
+	case attempt.Success:
+		d.ETag, d.LastModified = attempt.ETag, attempt.LastModified
+	}
+	d.trackChange(attempt, at, s.changeHistorySize)
+}
+
+// countSubmission counts the submission that added a new URL, the download
+// of which ended with attempt, unless it was a refetch
+func (s *URLStore) countSubmission(d *URLData, attempt Attempt, at time.Time) {
+	if attempt.Refetch {
+		return
+	}
+	d.Count = 1
+	d.LastSubmitted = at
+	s.countRecent(d, at)
+}
+
+// addSubmittedAs remembers a form the URL was submitted in, keeping the
+// maxSubmittedForms most recently seen
+func (d *URLData) addSubmittedAs(form string) {
+	forms := slices.DeleteFunc(d.SubmittedAs, func(f string) bool { return f == form })
+	if len(forms) >= maxSubmittedForms {
+		forms = slices.Delete(forms, 0, len(forms)-maxSubmittedForms+1)
+	}
+	d.SubmittedAs = append(forms, form)
 }
 
 type URLNode struct {
+	ID   string
 	URL  string
 	Data *URLData
 	Prev *URLNode
 	Next *URLNode
+
+	host string
+	// bucket is the node's place in the count index
+	bucket *countBucket
+	// seq increases every time the node moves to the tail, giving the list
+	// order a stable position for cursors
+	seq uint64
 }
 
+// URLStore keeps URLs in a map for lookups plus a doubly linked list ordered
+// from oldest to newest. All access goes through the requests channel and is
+// serialised by a single goroutine, so no locking is needed.
 type URLStore struct {
 	data map[string]*URLNode
+	ids  map[string]*URLNode
 	head *URLNode
 	tail *URLNode
+	seq  uint64
+
+	// pending holds the failed tries of URLs not in the store yet that are
+	// still being retried. They are recorded if a later try succeeds and
+	// dropped with the URL if none does.
+	pending map[string][]Attempt
+	// counts indexes the nodes by submission count for ranking by count
+	counts countIndex
+
+	// rejected holds the URLs discarded because their first download failed
+	rejected *rejectedList
+	// windows are counted over in windowBuckets buckets each for rankings
+	// by recent submissions
+	windows       []time.Duration
+	windowBuckets int
+
+	requests    chan Request
+	finished    chan struct{}
+	historySize int
+	// changeHistorySize is how many content changes are kept per URL
+	changeHistorySize int
+
+	dataDir          string
+	wal              *wal
+	snapshotInterval time.Duration
 }
 
+// Store is the storage backend used by the api and downloader packages.
 type Store interface {
-	update(url string, success bool, timeMs int64)
-	filter(n int, sortBy string) []*URLNode
+	Update(url string, attempt Attempt) bool
+	Filter(q Query) []*URLNode
+	Get(urlOrID string) (*URLNode, bool)
+	Rejected(limit int) []Rejected
+	GetRejected(urlOrID string) (Rejected, bool)
+	Promote(urlOrID string) (*URLNode, bool)
+	Windows() []time.Duration
+	Shutdown()
 }
 
-func New() {
-	store := URLStore{
-		data: make(map[string]*URLNode),
+// Config selects the store backend. The "memory" backend keeps everything in
+// memory, the "file" backend additionally persists to DataDir.
+type Config struct {
+	Backend                 string `yaml:"backend"`
+	DataDir                 string `yaml:"data_dir"`
+	SnapshotIntervalSeconds int    `yaml:"snapshot_interval_seconds"`
+	SyncWrites              bool   `yaml:"sync_writes"`
+	HistorySize             int    `yaml:"history_size"`
+	ChangeHistorySize       int    `yaml:"change_history_size"`
+	// MaxRejected and RejectedRetentionSeconds bound how many rejected URLs
+	// are kept and for how long, defaulting to 10000 and a week
+	MaxRejected              int `yaml:"max_rejected"`
+	RejectedRetentionSeconds int `yaml:"rejected_retention_seconds"`
+	// WindowsSeconds are the sliding windows submissions are counted over,
+	// each split into WindowBuckets buckets. They default to 5 minutes, an
+	// hour and a day in 12 buckets.
+	WindowsSeconds []int `yaml:"windows_seconds"`
+	WindowBuckets  int   `yaml:"window_buckets"`
+}
+
+// New starts the backend selected by cfg.
+func New(cfg Config) (Store, error) {
+	switch cfg.Backend {
+	case "", "memory":
+		return NewMemoryStore(cfg), nil
+	case "file":
+		return NewFileStore(cfg)
+	default:
+		return nil, fmt.Errorf("store: unknown backend %q", cfg.Backend)
 	}
-	go processStoreRequests(store)
 }
 
-func Shutdown() {
+// NewMemoryStore starts a store that only lives in memory, only the history
+// settings of cfg are used.
+func NewMemoryStore(cfg Config) *URLStore {
+	store := newURLStore(cfg)
+	go store.processRequests()
+	return store
+}
+
+func newURLStore(cfg Config) *URLStore {
+	historySize := cfg.HistorySize
+	if historySize <= 0 {
+		historySize = defaultHistorySize
+	}
+	changeHistorySize := cfg.ChangeHistorySize
+	if changeHistorySize <= 0 {
+		changeHistorySize = defaultChangeHistorySize
+	}
+
+	windows := defaultWindows
+	if len(cfg.WindowsSeconds) > 0 {
+		windows = nil
+		for _, seconds := range cfg.WindowsSeconds {
+			if seconds > 0 {
+				windows = append(windows, time.Duration(seconds)*time.Second)
+			}
+		}
+	}
+	windowBuckets := cfg.WindowBuckets
+	if windowBuckets <= 0 {
+		windowBuckets = defaultWindowBuckets
+	}
+
+	return &URLStore{
+		data:              make(map[string]*URLNode),
+		ids:               make(map[string]*URLNode),
+		pending:           make(map[string][]Attempt),
+		rejected:          newRejectedList(cfg.MaxRejected, time.Duration(cfg.RejectedRetentionSeconds)*time.Second),
+		requests:          make(chan Request),
+		finished:          make(chan struct{}),
+		historySize:       historySize,
+		changeHistorySize: changeHistorySize,
+		windows:           windows,
+		windowBuckets:     windowBuckets,
+	}
+}
+
+// Shutdown stops accepting requests and waits for the store to flush.
+func (s *URLStore) Shutdown() {
 	log.Println("store: attempting graceful shutdown")
-	close(Requests)
-	<-finished
+	close(s.requests)
+	<-s.finished
 	log.Println("store: shutdown complete")
 }
 
-func processStoreRequests(s URLStore) {
-	for request := range Requests {
-		switch request.Method {
-		case "update":
-			s.update(request.URL, request.Success, request.TimeMs)
-			request.Response <- Response{Output: "ok"}
-		case "filter":
-			data := s.filter(request.Number, request.SortBy)
-			request.Response <- Response{Output: data}
+func (s *URLStore) processRequests() {
+	var snapshots <-chan time.Time
+	if s.wal != nil && s.snapshotInterval > 0 {
+		ticker := time.NewTicker(s.snapshotInterval)
+		defer ticker.Stop()
+		snapshots = ticker.C
+	}
+
+	for {
+		select {
+		case request, ok := <-s.requests:
+			if !ok {
+				s.close()
+				close(s.finished)
+				return
+			}
+			s.handle(request)
+		case <-snapshots:
+			s.compact()
+		}
+	}
+}
+
+func (s *URLStore) handle(request Request) {
+	switch request.Method {
+	case "update":
+		now := time.Now()
+		s.persist(walEntry{
+			Op:      "update",
+			URL:     request.URL,
+			Attempt: request.Attempt,
+			At:      now,
+		})
+		stored := s.update(request.URL, request.Attempt, now)
+		request.Response <- Response{Output: stored}
+	case "filter":
+		data := s.filter(request.Query)
+		request.Response <- Response{Output: data}
+	case "get":
+		node, ok := s.get(request.URL)
+		if !ok {
+			request.Response <- Response{}
+			return
+		}
+		request.Response <- Response{Output: node}
+	case "rejected":
+		s.rejected.prune(time.Now())
+		request.Response <- Response{Output: s.rejected.list(request.Query.Limit)}
+	case "get_rejected":
+		s.rejected.prune(time.Now())
+		r, ok := s.rejected.lookup(request.URL)
+		if !ok {
+			request.Response <- Response{}
+			return
 		}
+		request.Response <- Response{Output: r.copy()}
+	case "promote":
+		r, ok := s.rejected.lookup(request.URL)
+		if !ok {
+			request.Response <- Response{}
+			return
+		}
+		now := time.Now()
+		s.persist(walEntry{Op: "promote", URL: r.URL, At: now})
+		request.Response <- Response{Output: s.promote(r.URL, now).copy()}
 	}
-	close(finished)
 }
 
-func Update(url string, success bool, timeMs int64) interface{} {
+// Update records a download attempt of the URL. It returns false if the URL
+// was discarded, which happens when the first download of a URL fails and
+// is not going to be retried. A discarded URL is kept among the rejected.
+func (s *URLStore) Update(url string, attempt Attempt) bool {
 	responseChan := make(chan Response)
 	defer close(responseChan)
 
-	Requests <- Request{
+	s.requests <- Request{
 		Method:   "update",
 		URL:      url,
-		Success:  success,
-		TimeMs:   timeMs,
+		Attempt:  attempt,
 		Response: responseChan,
 	}
 
 	response := <-responseChan
-	return response.Output
+	return response.Output.(bool)
 }
 
-func Filter(n int, sortBy string) []*URLNode {
+// Filter returns copies of the URLs matching the query in the order it asks for
+func (s *URLStore) Filter(q Query) []*URLNode {
 	responseChan := make(chan Response)
 	defer close(responseChan)
 
-	Requests <- Request{
+	s.requests <- Request{
 		Method:   "filter",
-		Number:   n,
-		SortBy:   sortBy,
+		Query:    q,
 		Response: responseChan,
 	}
 
@@ -111,87 +397,266 @@ func Filter(n int, sortBy string) []*URLNode {
 	return response.Output.([]*URLNode)
 }
 
-func (s *URLStore) update(url string, success bool, timeMs int64) {
+// Get returns a copy of the record for a URL, looked up either by the URL
+// itself or by its ID
+func (s *URLStore) Get(urlOrID string) (*URLNode, bool) {
+	responseChan := make(chan Response)
+	defer close(responseChan)
+
+	s.requests <- Request{
+		Method:   "get",
+		URL:      urlOrID,
+		Response: responseChan,
+	}
+
+	response := <-responseChan
+	node, ok := response.Output.(*URLNode)
+	return node, ok
+}
+
+// Rejected returns up to limit of the URLs discarded because their first
+// download failed, the most recently rejected first. A limit of 0 returns
+// all of them.
+func (s *URLStore) Rejected(limit int) []Rejected {
+	responseChan := make(chan Response)
+	defer close(responseChan)
+
+	s.requests <- Request{
+		Method:   "rejected",
+		Query:    Query{Limit: limit},
+		Response: responseChan,
+	}
+
+	response := <-responseChan
+	return response.Output.([]Rejected)
+}
+
+// GetRejected returns a copy of a rejected URL, looked up either by the URL
+// itself or by its ID
+func (s *URLStore) GetRejected(urlOrID string) (Rejected, bool) {
+	responseChan := make(chan Response)
+	defer close(responseChan)
+
+	s.requests <- Request{
+		Method:   "get_rejected",
+		URL:      urlOrID,
+		Response: responseChan,
+	}
+
+	response := <-responseChan
+	r, ok := response.Output.(Rejected)
+	return r, ok
+}
+
+// Promote moves a rejected URL into the store as it is, with its failed
+// tries, and returns a copy of its new record. It returns false if the URL
+// isn't rejected.
+func (s *URLStore) Promote(urlOrID string) (*URLNode, bool) {
+	responseChan := make(chan Response)
+	defer close(responseChan)
+
+	s.requests <- Request{
+		Method:   "promote",
+		URL:      urlOrID,
+		Response: responseChan,
+	}
+
+	response := <-responseChan
+	node, ok := response.Output.(*URLNode)
+	return node, ok
+}
+
+// URLID returns the stable identifier of a URL, a shortened SHA-256 of it, so
+// clients can refer to a URL in a path without escaping it
+func URLID(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return hex.EncodeToString(sum[:8])
+}
+
+func (s *URLStore) update(url string, attempt Attempt, at time.Time) bool {
 	// If this URL has already been submitted, update the data
 	if node, exists := s.data[url]; exists {
 		log.Printf("updating existing url: %s", url)
-		if node.Prev != nil {
-			node.Prev.Next = node.Next
-		} else {
-			s.head = node.Next
-		}
-
-		if node.Next != nil {
-			node.Next.Prev = node.Prev
-		} else {
-			s.tail = node.Prev
-		}
-
-		if success {
+		switch {
+		case attempt.Success:
 			node.Data.Successes++
-			node.Data.LastDownloadMs = timeMs
-		} else {
+			node.Data.LastDownloadMs = attempt.DurationMs
+			if attempt.NotModified() {
+				node.Data.NotModified++
+			}
+		case attempt.Blocked():
+			node.Data.Blocked++
+		default:
 			node.Data.Failures++
+			if attempt.Aborted() {
+				node.Data.Aborted++
+			}
 		}
+		s.record(node.Data, attempt, at)
 
-		node.Data.LastSubmitted = time.Now()
+		// Retries belong to a submission that has already been counted, and
+		// refetches aren't submissions
+		if !attempt.submission() {
+			return true
+		}
+
+		s.unlink(node)
+		node.Data.LastSubmitted = at
 		node.Data.Count++
+		s.counts.increment(node)
+		s.countRecent(node.Data, at)
 
 		// Move node to end
 		node.Prev, node.Next = s.tail, nil
 		if s.tail != nil {
 			s.tail.Next = node
+		} else {
+			// It was the only node, so it is the head again too
+			s.head = node
 		}
 		s.tail = node
+		s.seq++
+		node.seq = s.seq
 
-		return
+		return true
 
 	}
 
+	// A URL blocked by robots.txt is kept so the block shows up
+	if attempt.Blocked() {
+		log.Printf("adding new url blocked by robots.txt: %s", url)
+		newNode := &URLNode{
+			URL:  url,
+			Data: &URLData{Blocked: 1},
+		}
+		s.record(newNode.Data, attempt, at)
+		s.countSubmission(newNode.Data, attempt, at)
+
+		s.rejected.remove(url)
+		s.append(newNode)
+		return true
+	}
+
 	// URL hasn't been submitted, request was successful, add it to the map
-	if success {
+	// along with the tries that failed before it
+	if attempt.Success {
 		log.Printf("adding new url: %s", url)
+		failed := s.pending[url]
+		delete(s.pending, url)
+
 		newNode := &URLNode{
 			URL: url,
 			Data: &URLData{
-				Count:          1,
 				Successes:      1,
-				LastDownloadMs: timeMs,
-				LastSubmitted:  time.Now(),
+				Failures:       len(failed),
+				LastDownloadMs: attempt.DurationMs,
 			},
 		}
-
-		// Insert the new node at the tail
-		if s.tail == nil {
-			// if the list is empty, set head and tail
-			s.head, s.tail = newNode, newNode
-		} else {
-			// List isn't empty, append the new node to the tail
-			s.tail.Next = newNode
-			newNode.Prev = s.tail
-			s.tail = newNode
+		for _, a := range failed {
+			s.record(newNode.Data, a, at)
 		}
+		s.record(newNode.Data, attempt, at)
+		s.countSubmission(newNode.Data, attempt, at)
+
+		s.rejected.remove(url)
+		s.append(newNode)
+		return true
+	}
+
+	// Hold on to failed tries until we know whether the URL is kept
+	if attempt.Retrying {
+		s.pending[url] = append(s.pending[url], attempt)
+		return true
+	}
+
+	// The URL is discarded, keep why in the rejected list. That includes an
+	// aborted download, as the URL was never fully downloaded.
+	log.Printf("rejecting new url: %s", url)
+	failed := append(s.pending[url], attempt)
+	delete(s.pending, url)
+	r := s.rejected.add(url, failed, at)
+	r.Recent = s.addRecent(r.Recent, at)
+	return false
+}
 
-		s.data[url] = newNode
+// promote moves a rejected URL into the store, counting each rejected
+// submission, in the windows too, and recording the tries of the last one.
+// It goes to the tail of the list as submitted at the promotion, as the list
+// has to stay in submission order.
+func (s *URLStore) promote(url string, at time.Time) *URLNode {
+	r, _ := s.rejected.remove(url)
+	log.Printf("promoting rejected url: %s", url)
+
+	node := &URLNode{
+		URL: url,
+		Data: &URLData{
+			Count:         r.Rejections,
+			Failures:      r.Tries,
+			LastSubmitted: at,
+			Recent:        r.Recent,
+		},
+	}
+	for _, attempt := range r.Attempts {
+		if attempt.Aborted() {
+			node.Data.Aborted++
+		}
+		s.record(node.Data, attempt, at)
 	}
+	// Only the tries of the last rejection are kept, but each was a fetch
+	node.Data.Fetches = r.Rejections
 
+	s.append(node)
+	return node
 }
 
-func (s *URLStore) filter(n int, sortBy string) []*URLNode {
-	nodes := make([]*URLNode, 0, n)
-	current := s.tail
+// unlink removes a node from the list, leaving it in the maps
+func (s *URLStore) unlink(node *URLNode) {
+	if node.Prev != nil {
+		node.Prev.Next = node.Next
+	} else {
+		s.head = node.Next
+	}
 
-	for current != nil && len(nodes) < n {
-		nodes = append(nodes, current)
-		current = current.Prev
+	if node.Next != nil {
+		node.Next.Prev = node.Prev
+	} else {
+		s.tail = node.Prev
 	}
+}
 
-	// Sort by count, list is already sorted by newest to oldest
-	if sortBy == "count" {
-		sort.Slice(nodes, func(i, j int) bool {
-			return nodes[i].Data.Count > nodes[j].Data.Count
-		})
+// append inserts a node at the tail of the list and indexes it by URL.
+func (s *URLStore) append(node *URLNode) {
+	if s.tail == nil {
+		// if the list is empty, set head and tail
+		s.head, s.tail = node, node
+	} else {
+		// List isn't empty, append the new node to the tail
+		s.tail.Next = node
+		node.Prev = s.tail
+		s.tail = node
 	}
 
-	return nodes
+	s.seq++
+	node.seq = s.seq
+	node.ID = URLID(node.URL)
+	node.host = hostOf(node.URL)
+	s.data[node.URL] = node
+	s.ids[node.ID] = node
+	s.counts.add(node)
+}
+
+func (s *URLStore) get(urlOrID string) (*URLNode, bool) {
+	node, exists := s.data[urlOrID]
+	if !exists {
+		node, exists = s.ids[urlOrID]
+	}
+	if !exists {
+		return nil, false
+	}
+	return node.copy(), true
+}
+
+// copy returns a detached copy of the node, without its list pointers
+func (n *URLNode) copy() *URLNode {
+	return &URLNode{ID: n.ID, URL: n.URL, Data: n.Data.copy(), host: n.host, seq: n.seq}
 }
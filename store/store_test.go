@@ -5,29 +5,31 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"os"
 	"runtime/pprof"
+	"sort"
 	"testing"
 	"time"
 )
 
-func newStore(n int) {
-	New()
+func newStore(n int) *URLStore {
+	s := NewMemoryStore(Config{})
 	for i := 0; i < n; i++ {
-		Update(
+		s.Update(
 			fmt.Sprintf("http://example%d.com", i),
-			true,
-			int64(100+i),
+			Attempt{Success: true, DurationMs: int64(100 + i)},
 		)
 	}
+	return s
 }
 
 // TestStore_GetLatestURLs ensures that the latest n urls are returned
 // either by their time submitted or by their count
 func TestStore_GetLatestURLs(t *testing.T) {
-	newStore(15)
+	s := newStore(15)
 	log.SetOutput(io.Discard)
-	latest := Filter(5, "latest")
+	latest := s.Filter(Query{Limit: 5, SortBy: SortLatest})
 
 	// This list is in the order we expect back from the store when getting by "latest"
 	expectedURLS := []string{
@@ -48,17 +50,16 @@ func TestStore_GetLatestURLs(t *testing.T) {
 	n := 1
 	for i := 0; i < 5; i++ {
 		for j := 0; j < n; j++ {
-			Update(
+			s.Update(
 				fmt.Sprintf("http://example1%d.com", i),
-				true,
-				int64(100+i),
+				Attempt{Success: true, DurationMs: int64(100 + i)},
 			)
 		}
 		n++
 	}
 
 	// The 5 urls we got should now have counts 6, 5, 4, 3, 2 in that order
-	count := Filter(5, "count")
+	count := s.Filter(Query{Limit: 5, SortBy: SortCount})
 	for i, node := range count {
 		expectedCount := 6 - i
 		if node.Data.Count != expectedCount {
@@ -70,18 +71,17 @@ func TestStore_GetLatestURLs(t *testing.T) {
 
 // TestStore_GetTopURLs ensures that the top n counts on urls are returned
 func TestStore_GetTopURLs(t *testing.T) {
-	newStore(15)
+	s := newStore(15)
 	log.SetOutput(io.Discard)
 	// Update the first ten urls in the store with an extra counter
 	for i := 0; i < 10; i++ {
-		Update(
+		s.Update(
 			fmt.Sprintf("http://example%d.com", i),
-			true,
-			int64(100+i),
+			Attempt{Success: true, DurationMs: int64(100 + i)},
 		)
 	}
 
-	topURLS := Filter(10, "latest")
+	topURLS := s.Filter(Query{Limit: 10, SortBy: SortLatest})
 
 	for i := 0; i < len(topURLS); i++ {
 		if topURLS[i].Data.Count != 2 {
@@ -122,15 +122,12 @@ func TestStore_UpdateURL(t *testing.T) {
 		},
 	}
 
-	store := &URLStore{
-		data: make(map[string]*URLNode),
-	}
-	go processStoreRequests(*store)
+	store := newStore(15)
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 
-			_ = Update(tt.url, tt.success, tt.timeMs)
+			store.Update(tt.url, Attempt{Success: tt.success, DurationMs: tt.timeMs})
 
 			// Check the count of the last node
 			if store.tail.Data.Count != tt.expectedCount {
@@ -151,7 +148,7 @@ func BenchmarkGetLatestURLs(b *testing.B) {
 
 	log.SetOutput(ioutil.Discard)
 	// Populate the store with 1000 URLs
-	newStore(10000)
+	s := newStore(10000)
 
 	b.ResetTimer()
 
@@ -160,7 +157,7 @@ func BenchmarkGetLatestURLs(b *testing.B) {
 
 	// Benchmark fetching the latest 50 URLs
 	for i := 0; i < b.N; i++ {
-		Filter(50, "")
+		s.Filter(Query{Limit: 50})
 	}
 }
 
@@ -168,13 +165,13 @@ func BenchmarkGetLatestURLs(b *testing.B) {
 func BenchmarkGetCountURLs(b *testing.B) {
 	log.SetOutput(ioutil.Discard)
 	// Populate the store with 1000 URLs
-	newStore(10000)
+	s := newStore(10000)
 
 	b.ResetTimer()
 
 	// Benchmark fetching the latest 50 URLs
 	for i := 0; i < b.N; i++ {
-		Filter(10, "count")
+		s.Filter(Query{Limit: 10, SortBy: SortCount})
 	}
 }
 
@@ -182,10 +179,10 @@ func BenchmarkGetCountURLs(b *testing.B) {
 func BenchmarkGetTopURLs(b *testing.B) {
 	log.SetOutput(ioutil.Discard)
 	// Populate the store with 1000 URLs and update their count
-	newStore(10000)
+	s := newStore(10000)
 	for i := 0; i < 1000; i++ {
 		url := fmt.Sprintf("http://example%d", i)
-		Update(url, true, time.Now().UnixNano())
+		s.Update(url, Attempt{Success: true, DurationMs: time.Now().UnixNano()})
 	}
 
 	f, err := os.Create("cpu_profile.prof")
@@ -199,7 +196,69 @@ func BenchmarkGetTopURLs(b *testing.B) {
 
 	// Benchmark fetching the top 50 URLs based on count
 	for i := 0; i < b.N; i++ {
-		Filter(10, "")
+		s.Filter(Query{Limit: 10})
+	}
+}
+
+// Benchmark fetching the top 10 URLs by count from a large store where a few
+// URLs are submitted far more than the rest
+func BenchmarkGetTopCountURLs(b *testing.B) {
+	log.SetOutput(ioutil.Discard)
+	s := newStore(100000)
+	for i := 0; i < 10000; i++ {
+		url := fmt.Sprintf("http://example%d.com", i%100)
+		s.Update(url, Attempt{Success: true})
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.Filter(Query{Limit: 10, SortBy: SortCount})
+	}
+}
+
+// Benchmark paging deep into the URLs ranked by count, where most URLs share
+// the same count
+func BenchmarkGetCountURLsPage(b *testing.B) {
+	log.SetOutput(ioutil.Discard)
+	s := newStore(100000)
+	for i := 0; i < 10000; i++ {
+		url := fmt.Sprintf("http://example%d.com", i%100)
+		s.Update(url, Attempt{Success: true})
+	}
+	q := Query{Limit: 50, SortBy: SortCount}
+	page := s.Filter(Query{Limit: 5000, SortBy: SortCount})
+	cursor := CursorAfter(q, page[len(page)-1])
+	q.After = &cursor
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.Filter(q)
+	}
+}
+
+// Benchmark submitting URLs again, which moves them up the count index
+func BenchmarkResubmitURL(b *testing.B) {
+	log.SetOutput(ioutil.Discard)
+	s := newStore(100000)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		url := fmt.Sprintf("http://example%d.com", i%1000)
+		s.Update(url, Attempt{Success: true})
+	}
+}
+
+// Benchmark new submissions mixed with count rankings, where nearly every URL
+// is in the count 1 bucket that each new URL joins
+func BenchmarkSubmitAndGetCountURLs(b *testing.B) {
+	log.SetOutput(ioutil.Discard)
+	s := newStore(100000)
+	s.Update("http://example0.com", Attempt{Success: true})
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.Update(fmt.Sprintf("http://new%d.com", i), Attempt{Success: true})
+		s.Filter(Query{Limit: 10, SortBy: SortCount})
 	}
 }
 
@@ -213,7 +272,7 @@ func BenchmarkUpdateExistingURL(b *testing.B) {
 	}
 
 	// Populate the store with 1000 URLs
-	newStore(10000)
+	s := newStore(10000)
 
 	pprof.StartCPUProfile(f)
 	defer pprof.StopCPUProfile()
@@ -222,7 +281,7 @@ func BenchmarkUpdateExistingURL(b *testing.B) {
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		url := fmt.Sprintf("http://example%d", i)
-		Update(url, true, time.Now().UnixNano())
+		s.Update(url, Attempt{Success: true, DurationMs: time.Now().UnixNano()})
 	}
 }
 
@@ -236,7 +295,7 @@ func BenchmarkAddNewURL(b *testing.B) {
 	}
 
 	// Populate the store with 1000 URLs
-	newStore(0)
+	s := newStore(0)
 
 	pprof.StartCPUProfile(f)
 	defer pprof.StopCPUProfile()
@@ -249,7 +308,641 @@ func BenchmarkAddNewURL(b *testing.B) {
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		Update(urls[i], true, time.Now().UnixNano())
+		s.Update(urls[i], Attempt{Success: true, DurationMs: time.Now().UnixNano()})
+	}
+
+}
+
+// TestStore_Recover ensures that updates written to the wal, and those
+// compacted into a snapshot, are restored by a new store on the same data dir
+func TestStore_Recover(t *testing.T) {
+	log.SetOutput(io.Discard)
+	cfg := Config{DataDir: t.TempDir()}
+
+	update := func(s *URLStore, url string, attempt Attempt) {
+		response := make(chan Response, 1)
+		s.handle(Request{Method: "update", URL: url, Attempt: attempt, Response: response})
+		<-response
+	}
+	apply := func(s *URLStore, url string, success bool) {
+		update(s, url, Attempt{Success: success, DurationMs: 100})
+	}
+
+	first := newURLStore(Config{})
+	if err := first.recover(cfg); err != nil {
+		t.Fatalf("could not open store: %v", err)
+	}
+	apply(first, "http://example0.com", true)
+	apply(first, "http://example1.com", true)
+	apply(first, "http://rejected0.com", false)
+	apply(first, "http://rejected1.com", false)
+	update(first, "http://retried.com", Attempt{Try: 1, Retrying: true, DurationMs: 100})
+
+	// Compact the first urls, and the failed try of the url being retried,
+	// into a snapshot, the rest only live in the wal
+	first.compact()
+	apply(first, "http://example0.com", false)
+	apply(first, "http://example2.com", true)
+	apply(first, "http://rejected2.com", false)
+	update(first, "http://retried.com", Attempt{Try: 2, Success: true, DurationMs: 100})
+	response := make(chan Response, 1)
+	first.handle(Request{Method: "promote", URL: "http://rejected1.com", Response: response})
+	<-response
+	if err := first.wal.close(); err != nil {
+		t.Fatalf("could not close wal: %v", err)
+	}
+
+	second := newURLStore(Config{})
+	if err := second.recover(cfg); err != nil {
+		t.Fatalf("could not recover store: %v", err)
+	}
+	defer second.close()
+
+	expected := []struct {
+		url      string
+		count    int
+		failures int
+		history  int
+	}{
+		{url: "http://rejected1.com", count: 1, failures: 1, history: 1},
+		{url: "http://retried.com", count: 1, failures: 1, history: 2},
+		{url: "http://example2.com", count: 1, history: 1},
+		{url: "http://example0.com", count: 2, failures: 1, history: 2},
+		{url: "http://example1.com", count: 1, history: 1},
+	}
+
+	latest := second.filter(Query{Limit: 10, SortBy: SortLatest})
+	if len(latest) != len(expected) {
+		t.Fatalf("expected %d urls, got %d", len(expected), len(latest))
+	}
+	for i, node := range latest {
+		if node.URL != expected[i].url || node.Data.Count != expected[i].count ||
+			node.Data.Failures != expected[i].failures || node.Data.History.Len() != expected[i].history {
+			t.Errorf("expected %+v, got %s with count %d, failures %d and %d attempts",
+				expected[i], node.URL, node.Data.Count, node.Data.Failures, node.Data.History.Len())
+		}
+	}
+
+	// The count index is rebuilt too
+	if top := second.filter(Query{Limit: 1, SortBy: SortCount}); len(top) != 1 || top[0].URL != "http://example0.com" {
+		t.Errorf("expected http://example0.com to have the highest count, got %+v", top)
+	}
+
+	rejected := second.rejected.list(0)
+	if len(rejected) != 2 || rejected[0].URL != "http://rejected2.com" || rejected[1].URL != "http://rejected0.com" {
+		t.Errorf("expected the rejected urls to be recovered, got %+v", rejected)
+	}
+}
+
+// TestHistory_Stats ensures the ring buffer only keeps the most recent attempts
+// and that latency stats are derived from the successful ones
+func TestHistory_Stats(t *testing.T) {
+	var h History
+	for i := 1; i <= 120; i++ {
+		h.add(Attempt{Success: true, DurationMs: int64(i)}, 100)
+	}
+	h.add(Attempt{Success: false, DurationMs: 5000}, 100)
+
+	attempts := h.Attempts()
+	if len(attempts) != 100 {
+		t.Fatalf("expected 100 attempts, got %d", len(attempts))
+	}
+	if attempts[0].DurationMs != 22 || attempts[99].Success {
+		t.Errorf("expected attempts 22 to 120 followed by the failure, got first %d and last %+v",
+			attempts[0].DurationMs, attempts[99])
+	}
+
+	// The 99 successful attempts left are 22ms to 120ms
+	stats := h.Stats()
+	expected := LatencyStats{Samples: 99, MinMs: 22, MaxMs: 120, MeanMs: 71, P50Ms: 71, P90Ms: 111, P99Ms: 120}
+	if stats != expected {
+		t.Errorf("expected %+v, got %+v", expected, stats)
+	}
+
+	// Phases are averaged over the attempts that have their timing
+	h.add(Attempt{Success: true, DurationMs: 30, Timing: &Timing{DNSMs: 10, TTFBMs: 20, TotalMs: 30}}, 100)
+	h.add(Attempt{Success: true, DurationMs: 10, Timing: &Timing{TTFBMs: 6, TransferMs: 4, TotalMs: 10}}, 100)
+	h.add(Attempt{Success: false, DurationMs: 50, Timing: &Timing{DNSMs: 50, TotalMs: 50}}, 100)
+	phases := h.Stats().Phases
+	expectedPhases := PhaseStats{Samples: 2, DNSMs: 5, TTFBMs: 13, TransferMs: 2}
+	if phases == nil || *phases != expectedPhases {
+		t.Errorf("expected phases %+v, got %+v", expectedPhases, phases)
+	}
+}
+
+// TestStore_FilterQuery ensures the filters and sort orders are applied across
+// the whole store rather than only the newest urls
+func TestStore_FilterQuery(t *testing.T) {
+	s := newStore(0)
+	update := func(url string, success bool, timeMs int64) {
+		s.Update(url, Attempt{Success: success, DurationMs: timeMs})
+	}
+
+	// a.com: count 3, failing on its last download
+	update("http://a.com/1", true, 300)
+	update("http://a.com/1", true, 300)
+	update("http://a.com/1", false, 0)
+	// b.com: count 2, healthy
+	update("http://b.com/1", true, 50)
+	update("http://b.com/1", true, 100)
+	// a.com/2 and c.com: count 1, the newest urls
+	update("http://A.com/2", true, 200)
+	update("http://c.com/1", true, 10)
+
+	tests := []struct {
+		name     string
+		query    Query
+		expected []string
+	}{
+		{
+			name:     "count ranks the whole store",
+			query:    Query{Limit: 2, SortBy: SortCount},
+			expected: []string{"http://a.com/1", "http://b.com/1"},
+		},
+		{
+			name:     "failures",
+			query:    Query{Limit: 1, SortBy: SortFailures},
+			expected: []string{"http://a.com/1"},
+		},
+		{
+			name:     "success rate ascending",
+			query:    Query{Limit: 1, SortBy: SortSuccessRate, Ascending: true},
+			expected: []string{"http://a.com/1"},
+		},
+		{
+			name:     "latency",
+			query:    Query{Limit: 4, SortBy: SortLatency},
+			expected: []string{"http://a.com/1", "http://A.com/2", "http://b.com/1", "http://c.com/1"},
+		},
+		{
+			name:     "oldest first",
+			query:    Query{Limit: 2, SortBy: SortLatest, Ascending: true},
+			expected: []string{"http://a.com/1", "http://b.com/1"},
+		},
+		{
+			name:     "host filter is case insensitive",
+			query:    Query{Limit: 10, SortBy: SortLatest, Host: "a.com"},
+			expected: []string{"http://A.com/2", "http://a.com/1"},
+		},
+		{
+			name:     "min count",
+			query:    Query{Limit: 10, SortBy: SortLatest, MinCount: 2},
+			expected: []string{"http://b.com/1", "http://a.com/1"},
+		},
+		{
+			name:     "failing only",
+			query:    Query{Limit: 10, SortBy: SortCount, FailingOnly: true},
+			expected: []string{"http://a.com/1"},
+		},
+		{
+			name:     "submitted in the future",
+			query:    Query{Limit: 10, SortBy: SortLatest, Since: time.Now().Add(time.Hour)},
+			expected: []string{},
+		},
 	}
 
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodes := s.Filter(tt.query)
+			if len(nodes) != len(tt.expected) {
+				t.Fatalf("expected %d urls, got %d", len(tt.expected), len(nodes))
+			}
+			for i, node := range nodes {
+				if node.URL != tt.expected[i] {
+					t.Errorf("expected %s at %d, got %s", tt.expected[i], i, node.URL)
+				}
+			}
+		})
+	}
+}
+
+// TestStore_FilterCursor ensures paging by a sort key with ties returns every
+// url exactly once
+func TestStore_FilterCursor(t *testing.T) {
+	s := newStore(5)
+	s.Update("http://example3.com", Attempt{Success: true})
+
+	query := Query{Limit: 2, SortBy: SortCount}
+	seen := make(map[string]bool)
+	for page := 0; page < 3; page++ {
+		nodes := s.Filter(query)
+		for _, node := range nodes {
+			if seen[node.URL] {
+				t.Errorf("%s listed twice", node.URL)
+			}
+			seen[node.URL] = true
+		}
+		if page == 0 && nodes[0].URL != "http://example3.com" {
+			t.Errorf("expected http://example3.com first, got %s", nodes[0].URL)
+		}
+
+		cursor, err := DecodeCursor(CursorAfter(query, nodes[len(nodes)-1]).Encode(), query)
+		if err != nil {
+			t.Fatalf("could not decode cursor: %v", err)
+		}
+		query.After = cursor
+	}
+
+	if len(seen) != 5 {
+		t.Errorf("expected all 5 urls to be listed, got %d", len(seen))
+	}
+	if _, err := DecodeCursor("not-a-cursor", query); err == nil {
+		t.Errorf("expected an invalid cursor to be rejected")
+	}
+}
+
+// TestStore_UpdateRetries ensures retried tries are recorded as attempts of a
+// single submission and that a new url is only kept if a try succeeds
+func TestStore_UpdateRetries(t *testing.T) {
+	s := newStore(0)
+
+	s.Update("http://kept.com", Attempt{Try: 1, Retrying: true, StatusCode: 503})
+	s.Update("http://kept.com", Attempt{Try: 2, Success: true, DurationMs: 50})
+	s.Update("http://dropped.com", Attempt{Try: 1, Retrying: true, StatusCode: 503})
+	if stored := s.Update("http://dropped.com", Attempt{Try: 2, StatusCode: 503}); stored {
+		t.Errorf("expected a url whose every try failed to be discarded")
+	}
+
+	s.Update("http://existing.com", Attempt{Success: true})
+	s.Update("http://existing.com", Attempt{Try: 1, Retrying: true, StatusCode: 500})
+	s.Update("http://existing.com", Attempt{Try: 2, StatusCode: 500})
+
+	tests := []struct {
+		url       string
+		count     int
+		successes int
+		failures  int
+	}{
+		{url: "http://kept.com", count: 1, successes: 1, failures: 1},
+		{url: "http://existing.com", count: 2, successes: 1, failures: 2},
+	}
+
+	for _, tt := range tests {
+		node, ok := s.Get(tt.url)
+		if !ok {
+			t.Fatalf("expected %s to be stored", tt.url)
+		}
+		data := node.Data
+		if data.Count != tt.count || data.Successes != tt.successes || data.Failures != tt.failures ||
+			data.History.Len() != tt.successes+tt.failures {
+			t.Errorf("expected %+v, got %+v", tt, data)
+		}
+	}
+	if _, ok := s.Get("http://dropped.com"); ok {
+		t.Errorf("expected http://dropped.com to be discarded")
+	}
+	if len(s.pending) != 0 {
+		t.Errorf("expected no pending tries to be left, got %v", s.pending)
+	}
+}
+
+// TestStore_Changes ensures content changes are tracked per url, bounded,
+// and can be filtered on
+func TestStore_Changes(t *testing.T) {
+	s := NewMemoryStore(Config{ChangeHistorySize: 3})
+	download := func(url, sha, text string) {
+		s.Update(url, Attempt{Success: true, SHA256: sha, TextHash: text})
+	}
+
+	download("http://static.com", "a", "x")
+	download("http://static.com", "a", "x")
+	download("http://changing.com", "a", "x")
+	download("http://changing.com", "b", "x")
+	// A failed download says nothing about the content
+	s.Update("http://changing.com", Attempt{Success: false, StatusCode: 500})
+	before := time.Now()
+	download("http://changing.com", "c", "y")
+	download("http://changing.com", "d", "z")
+
+	static, _ := s.Get("http://static.com")
+	if static.Data.ChangeCount != 0 || len(static.Data.Changes) != 1 || !static.Data.LastChanged.IsZero() {
+		t.Errorf("expected only the first fingerprint for an unchanged url, got %+v", static.Data)
+	}
+
+	changing, _ := s.Get("http://changing.com")
+	changes := changing.Data.Changes
+	if changing.Data.ChangeCount != 3 || len(changes) != 3 {
+		t.Fatalf("expected 3 changes with the oldest dropped, got %d and %+v", changing.Data.ChangeCount, changes)
+	}
+	if changes[0].SHA256 != "b" || changes[0].TextChanged || !changes[1].TextChanged || changes[2].SHA256 != "d" {
+		t.Errorf("unexpected change timeline %+v", changes)
+	}
+
+	changed := s.Filter(Query{Limit: 10, ChangedSince: before})
+	if len(changed) != 1 || changed[0].URL != "http://changing.com" {
+		t.Errorf("expected only http://changing.com to have changed, got %d urls", len(changed))
+	}
+}
+
+// TestStore_NotModified ensures 304s count as successes without touching the
+// content timeline and that the validators follow the last body
+func TestStore_NotModified(t *testing.T) {
+	s := NewMemoryStore(Config{})
+	url := "http://example.com"
+
+	s.Update(url, Attempt{Success: true, StatusCode: 200, SHA256: "a", ETag: `"v1"`, LastModified: "yesterday"})
+	s.Update(url, Attempt{Success: true, StatusCode: 304, Outcome: OutcomeNotModified, ETag: `"v2"`})
+
+	node, _ := s.Get(url)
+	data := node.Data
+	if data.Successes != 2 || data.NotModified != 1 || data.ChangeCount != 0 || len(data.Changes) != 1 {
+		t.Errorf("expected a not modified success, got %+v", data)
+	}
+	if data.ETag != `"v2"` || data.LastModified != "yesterday" {
+		t.Errorf("expected the etag to be refreshed and last modified kept, got %q and %q", data.ETag, data.LastModified)
+	}
+
+	// A new body without validators clears them
+	s.Update(url, Attempt{Success: true, StatusCode: 200, SHA256: "b"})
+	node, _ = s.Get(url)
+	if node.Data.ETag != "" || node.Data.LastModified != "" || node.Data.ChangeCount != 1 {
+		t.Errorf("expected the validators to be cleared, got %+v", node.Data)
+	}
+}
+
+// TestStore_SubmittedAs ensures the submitted forms of a url are kept once
+// each, most recent last, up to the limit
+func TestStore_SubmittedAs(t *testing.T) {
+	s := NewMemoryStore(Config{})
+	url := "http://example.com/"
+
+	s.Update(url, Attempt{Success: true, Submitted: "http://Example.com"})
+	s.Update(url, Attempt{Success: true})
+	s.Update(url, Attempt{Success: true, Submitted: "http://example.com/#top"})
+	s.Update(url, Attempt{Success: true, Submitted: "http://Example.com"})
+
+	node, _ := s.Get(url)
+	if fmt.Sprint(node.Data.SubmittedAs) != "[http://example.com/#top http://Example.com]" {
+		t.Errorf("unexpected submitted forms %v", node.Data.SubmittedAs)
+	}
+
+	for i := 0; i < maxSubmittedForms+5; i++ {
+		s.Update(url, Attempt{Success: true, Submitted: fmt.Sprintf("http://example.com/?utm_id=%d", i)})
+	}
+	node, _ = s.Get(url)
+	forms := node.Data.SubmittedAs
+	if len(forms) != maxSubmittedForms || forms[len(forms)-1] != fmt.Sprintf("http://example.com/?utm_id=%d", maxSubmittedForms+4) {
+		t.Errorf("expected the %d most recent forms, got %v", maxSubmittedForms, forms)
+	}
+}
+
+// TestStore_Rejected ensures discarded urls are kept with why, until they are
+// downloaded, promoted or pruned
+func TestStore_Rejected(t *testing.T) {
+	s := NewMemoryStore(Config{MaxRejected: 2})
+	url := "http://broken.com"
+
+	s.Update(url, Attempt{Try: 1, Retrying: true, StatusCode: 503, Error: "unexpected status 503"})
+	s.Update(url, Attempt{Try: 2, StatusCode: 404, Error: "unexpected status 404"})
+	s.Update(url, Attempt{Error: "connection refused"})
+
+	r, ok := s.GetRejected(URLID(url))
+	if !ok {
+		t.Fatalf("expected %s to be rejected", url)
+	}
+	if r.URL != url || r.Reason != "connection refused" || r.StatusCode != 0 || r.Rejections != 2 || r.Tries != 3 ||
+		len(r.Attempts) != 1 || r.FirstRejected.After(r.LastRejected) {
+		t.Errorf("unexpected rejected url %+v", r)
+	}
+
+	// A successful download takes the url out of the rejected list
+	s.Update("http://flaky.com", Attempt{StatusCode: 500, Error: "unexpected status 500"})
+	s.Update("http://flaky.com", Attempt{Success: true})
+	if _, ok := s.GetRejected("http://flaky.com"); ok {
+		t.Errorf("expected a downloaded url not to be rejected")
+	}
+
+	// Only the most recently rejected urls are kept
+	s.Update("http://second.com", Attempt{Error: "timeout"})
+	s.Update("http://third.com", Attempt{Error: "timeout"})
+	rejected := s.Rejected(0)
+	if len(rejected) != 2 || rejected[0].URL != "http://third.com" || rejected[1].URL != "http://second.com" {
+		t.Errorf("expected the two most recent rejected urls, got %+v", rejected)
+	}
+	if limited := s.Rejected(1); len(limited) != 1 || limited[0].URL != "http://third.com" {
+		t.Errorf("expected only the most recent rejected url, got %+v", limited)
+	}
+
+	// Promoting stores the url with its failures, even after others were
+	// submitted since it was rejected
+	s.Update("http://fine.com", Attempt{Success: true})
+	node, ok := s.Promote("http://second.com")
+	if !ok || node.Data.Count != 1 || node.Data.Successes != 0 || node.Data.Failures != 1 || node.Data.History.Len() != 1 {
+		t.Fatalf("expected the promoted url to be stored with its failure, got %+v", node)
+	}
+	if _, ok := s.GetRejected("http://second.com"); ok {
+		t.Errorf("expected a promoted url not to be rejected")
+	}
+	// It counts in the windows and is the latest submitted, keeping the list
+	// in submission order
+	if recent := node.Data.RecentCount(time.Hour, time.Now()); recent != 1 {
+		t.Errorf("expected the rejection to count in the window, got %d", recent)
+	}
+	if top := s.Filter(Query{Limit: 1, SortBy: SortCount, Window: time.Hour}); len(top) != 1 || top[0].URL != "http://second.com" {
+		t.Errorf("expected the promoted url in the window ranking, got %+v", top)
+	}
+	latest := s.Filter(Query{Limit: 10})
+	if len(latest) != 3 || latest[0].URL != "http://second.com" {
+		t.Errorf("expected the promoted url to be the latest submitted, got %+v", latest)
+	}
+	for i := 1; i < len(latest); i++ {
+		if latest[i].Data.LastSubmitted.After(latest[i-1].Data.LastSubmitted) {
+			t.Errorf("expected the list in submission order, got %s before %s", latest[i-1].URL, latest[i].URL)
+		}
+	}
+	if _, ok := s.Promote("http://second.com"); ok {
+		t.Errorf("expected a url that isn't rejected not to be promoted")
+	}
+
+	// An aborted first download is rejected too, keeping its outcome
+	s.Update("http://huge.com", Attempt{Outcome: OutcomeAborted, Bytes: 10, Error: "aborted: body is larger than 10 bytes"})
+	if _, ok := s.Get("http://huge.com"); ok {
+		t.Errorf("expected an aborted first download not to be stored")
+	}
+	if r, ok := s.GetRejected("http://huge.com"); !ok || r.Outcome != OutcomeAborted {
+		t.Fatalf("expected an aborted rejection, got %+v", r)
+	}
+	if node, ok := s.Promote("http://huge.com"); !ok || node.Data.Aborted != 1 || node.Data.Failures != 1 {
+		t.Errorf("expected the promoted url to count its abort, got %+v", node)
+	}
+}
+
+// TestStore_Refetches ensures refetches count as fetches but not as
+// submissions, so they don't change the submission rankings
+func TestStore_Refetches(t *testing.T) {
+	s := newStore(0)
+
+	s.Update("http://submitted.com", Attempt{Success: true})
+	s.Update("http://refetched.com", Attempt{Success: true})
+	submitted, _ := s.Get("http://refetched.com")
+	s.Update("http://submitted.com", Attempt{Success: true})
+
+	s.Update("http://refetched.com", Attempt{Success: true, Refetch: true})
+	s.Update("http://refetched.com", Attempt{Try: 1, Retrying: true, StatusCode: 503, Refetch: true})
+	s.Update("http://refetched.com", Attempt{Try: 2, Success: true, Refetch: true})
+	s.Update("http://refetched.com", Attempt{Outcome: OutcomeBlockedRobots, Refetch: true})
+
+	node, _ := s.Get("http://refetched.com")
+	data := node.Data
+	if data.Count != 1 || data.Fetches != 3 || data.Successes != 3 || data.Failures != 1 || data.Blocked != 1 {
+		t.Errorf("expected 1 submission and 3 fetches, got %+v", data)
+	}
+	if !data.LastSubmitted.Equal(submitted.Data.LastSubmitted) || !data.LastFetched.After(data.LastSubmitted) {
+		t.Errorf("expected only the last fetch to move, got submitted %s and fetched %s", data.LastSubmitted, data.LastFetched)
+	}
+
+	tests := []struct {
+		sortBy   string
+		expected string
+	}{
+		{sortBy: SortLatest, expected: "http://submitted.com"},
+		{sortBy: SortCount, expected: "http://submitted.com"},
+		{sortBy: SortFetches, expected: "http://refetched.com"},
+		{sortBy: SortLastFetched, expected: "http://refetched.com"},
+	}
+	for _, tt := range tests {
+		if top := s.Filter(Query{Limit: 1, SortBy: tt.sortBy}); len(top) != 1 || top[0].URL != tt.expected {
+			t.Errorf("expected %s first by %s, got %+v", tt.expected, tt.sortBy, top)
+		}
+	}
+}
+
+// TestWindowCount ensures submissions drop out of a window a bucket at a time
+// and ones older than the window are ignored
+func TestWindowCount(t *testing.T) {
+	// A minute in six buckets of 10s
+	c := WindowCount{Seconds: 60, Buckets: make([]uint32, 6)}
+	start := time.Unix(1_000_000, 0)
+	at := func(seconds int) time.Time { return start.Add(time.Duration(seconds) * time.Second) }
+
+	c.add(at(0))
+	c.add(at(15))
+	c.add(at(15))
+
+	tests := []struct {
+		seconds  int
+		expected int
+	}{
+		{seconds: 15, expected: 3},
+		{seconds: 59, expected: 3},
+		{seconds: 60, expected: 2},
+		{seconds: 79, expected: 0},
+	}
+	for _, tt := range tests {
+		if got := c.count(at(tt.seconds)); got != tt.expected {
+			t.Errorf("expected %d submissions at %ds, got %d", tt.expected, tt.seconds, got)
+		}
+	}
+
+	c.add(at(70))
+	c.add(at(5))
+	if got := c.count(at(70)); got != 1 {
+		t.Errorf("expected the expired buckets to be emptied and the late submission ignored, got %d", got)
+	}
+}
+
+// TestStore_Windows ensures rankings can be limited to recent submissions
+func TestStore_Windows(t *testing.T) {
+	s := newURLStore(Config{WindowsSeconds: []int{300, 3600}, WindowBuckets: 6})
+	now := time.Now()
+	submit := func(url string, times int, ago time.Duration) {
+		for i := 0; i < times; i++ {
+			s.update(url, Attempt{Success: true}, now.Add(-ago))
+		}
+	}
+
+	submit("http://yesterday.com", 5, 24*time.Hour)
+	submit("http://hour.com", 3, 30*time.Minute)
+	submit("http://now.com", 2, time.Minute)
+	// Refetches aren't submissions
+	s.update("http://yesterday.com", Attempt{Success: true, Refetch: true}, now)
+
+	tests := []struct {
+		name     string
+		query    Query
+		expected string
+	}{
+		{name: "ever", query: Query{SortBy: SortCount}, expected: "[http://yesterday.com http://hour.com http://now.com]"},
+		{name: "last hour", query: Query{SortBy: SortCount, Window: time.Hour}, expected: "[http://hour.com http://now.com http://yesterday.com]"},
+		{name: "last 5 minutes", query: Query{SortBy: SortCount, Window: 5 * time.Minute, MinCount: 1}, expected: "[http://now.com]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.query.Limit, tt.query.At = 10, now
+			var urls []string
+			for _, node := range s.filter(tt.query) {
+				urls = append(urls, node.URL)
+			}
+			if fmt.Sprint(urls) != tt.expected {
+				t.Errorf("expected %s, got %v", tt.expected, urls)
+			}
+		})
+	}
+
+	node, _ := s.get("http://now.com")
+	if got := node.Data.RecentCount(5*time.Minute, now); got != 2 {
+		t.Errorf("expected 2 recent submissions, got %d", got)
+	}
+	if got := node.Data.RecentCount(24*time.Hour, now); got != 0 {
+		t.Errorf("expected no count for a window the store doesn't have, got %d", got)
+	}
+}
+
+// TestStore_CountIndex ensures ranking by count through the index matches
+// sorting the whole store, page after page
+func TestStore_CountIndex(t *testing.T) {
+	log.SetOutput(io.Discard)
+	s := newURLStore(Config{})
+	random := rand.New(rand.NewSource(1))
+	now := time.Now()
+	for i := 0; i < 2000; i++ {
+		url := fmt.Sprintf("http://host%d.com/%d", random.Intn(3), random.Intn(300))
+		s.update(url, Attempt{Success: true, Refetch: random.Intn(10) == 0}, now)
+	}
+
+	tests := []struct {
+		name  string
+		query Query
+	}{
+		{name: "descending", query: Query{SortBy: SortCount}},
+		{name: "ascending", query: Query{SortBy: SortCount, Ascending: true}},
+		{name: "min count", query: Query{SortBy: SortCount, MinCount: 4}},
+		{name: "host", query: Query{SortBy: SortCount, Host: "host1.com", Ascending: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var expected []string
+			all := s.filter(Query{Limit: len(s.data)})
+			sort.Slice(all, func(i, j int) bool {
+				if all[i].Data.Count != all[j].Data.Count {
+					return (all[i].Data.Count > all[j].Data.Count) != tt.query.Ascending
+				}
+				return all[i].ID < all[j].ID
+			})
+			for _, node := range all {
+				if tt.query.matches(node) {
+					expected = append(expected, node.URL)
+				}
+			}
+
+			var got []string
+			q := tt.query
+			q.Limit = 7
+			for {
+				page := s.filter(q)
+				for _, node := range page {
+					got = append(got, node.URL)
+				}
+				if len(page) < q.Limit {
+					break
+				}
+				cursor := CursorAfter(q, page[len(page)-1])
+				q.After = &cursor
+			}
+
+			if len(expected) == 0 || fmt.Sprint(got) != fmt.Sprint(expected) {
+				t.Errorf("expected %d urls %v, got %d %v", len(expected), expected, len(got), got)
+			}
+		})
+	}
 }
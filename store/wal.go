@@ -0,0 +1,113 @@
+package store
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const walFileName = "wal.log"
+
+// walEntry is a single mutation appended to the write-ahead log. Seq is
+// monotonically increasing so entries already covered by a snapshot can be
+// skipped on replay.
+type walEntry struct {
+	Seq     uint64    `json:"seq"`
+	Op      string    `json:"op"`
+	URL     string    `json:"url"`
+	Attempt Attempt   `json:"attempt"`
+	At      time.Time `json:"at"`
+}
+
+type wal struct {
+	path string
+	file *os.File
+	sync bool
+	seq  uint64
+}
+
+func openWAL(dir string, sync bool) (*wal, error) {
+	path := filepath.Join(dir, walFileName)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("opening wal %s: %w", path, err)
+	}
+
+	return &wal{path: path, file: f, sync: sync}, nil
+}
+
+// append writes the entry to the end of the log, assigning it the next
+// sequence number.
+func (w *wal) append(entry walEntry) error {
+	w.seq++
+	entry.Seq = w.seq
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("encoding wal entry: %w", err)
+	}
+
+	if _, err := w.file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("writing wal entry: %w", err)
+	}
+
+	if w.sync {
+		return w.file.Sync()
+	}
+	return nil
+}
+
+// replay calls apply for every entry with a sequence number greater than
+// after. A torn final line, as left by a crash mid-write, is ignored.
+func (w *wal) replay(after uint64, apply func(walEntry)) (int, error) {
+	if _, err := w.file.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	w.seq = after
+	replayed := 0
+	scanner := bufio.NewScanner(w.file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry walEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			log.Printf("store: skipping corrupt wal entry: %s", err)
+			continue
+		}
+
+		if entry.Seq > w.seq {
+			w.seq = entry.Seq
+		}
+		if entry.Seq <= after {
+			continue
+		}
+
+		apply(entry)
+		replayed++
+	}
+
+	return replayed, scanner.Err()
+}
+
+// truncate discards every entry in the log, called once a snapshot covering
+// them has been written.
+func (w *wal) truncate() error {
+	if err := w.file.Truncate(0); err != nil {
+		return err
+	}
+	_, err := w.file.Seek(0, io.SeekStart)
+	return err
+}
+
+func (w *wal) close() error {
+	if w == nil {
+		return nil
+	}
+	return errors.Join(w.file.Sync(), w.file.Close())
+}
@@ -0,0 +1,137 @@
+package store
+
+import (
+	"strings"
+	"time"
+)
+
+const defaultWindowBuckets = 12
+
+// defaultWindows are the windows submissions are counted over when none are
+// configured
+var defaultWindows = []time.Duration{5 * time.Minute, time.Hour, 24 * time.Hour}
+
+// WindowCount counts the submissions of a URL over a sliding window. The
+// window is split into buckets, the oldest of which is dropped as each new
+// one starts, so the count decays a bucket at a time rather than all at once
+// and is only ever off by up to a bucket's width.
+type WindowCount struct {
+	Seconds int `json:"seconds"`
+	// Last is the index of the newest bucket, counting bucket widths since
+	// the Unix epoch. Buckets is a ring holding it and the ones before it.
+	Last    int64    `json:"last"`
+	Buckets []uint32 `json:"buckets"`
+}
+
+func (c *WindowCount) width() int64 {
+	return int64(time.Duration(c.Seconds) * time.Second / time.Duration(len(c.Buckets)))
+}
+
+// add counts a submission made at the given time
+func (c *WindowCount) add(at time.Time) {
+	n := int64(len(c.Buckets))
+	index := at.UnixNano() / c.width()
+	switch {
+	case index > c.Last:
+		// Empty the buckets that have fallen out of the window since the
+		// newest one was started
+		for i := max(c.Last+1, index-n+1); i <= index; i++ {
+			c.Buckets[i%n] = 0
+		}
+		c.Last = index
+	case index <= c.Last-n:
+		// Older than the window already
+		return
+	}
+	c.Buckets[index%n]++
+}
+
+// count returns the submissions in the window ending at now
+func (c *WindowCount) count(now time.Time) int {
+	n := int64(len(c.Buckets))
+	current := now.UnixNano() / c.width()
+	total := 0
+	for i := max(c.Last-n+1, current-n+1); i <= c.Last; i++ {
+		total += int(c.Buckets[i%n])
+	}
+	return total
+}
+
+// RecentCount returns how many times the URL was submitted in the window
+// ending at now, 0 if the store doesn't count over that window
+func (d *URLData) RecentCount(window time.Duration, now time.Time) int {
+	for i := range d.Recent {
+		if time.Duration(d.Recent[i].Seconds)*time.Second == window {
+			return d.Recent[i].count(now)
+		}
+	}
+	return 0
+}
+
+// countRecent counts a submission in every window
+func (s *URLStore) countRecent(d *URLData, at time.Time) {
+	d.Recent = s.addRecent(d.Recent, at)
+}
+
+// addRecent counts a submission made at the given time in every window of
+// recent, adding the windows it doesn't have yet
+func (s *URLStore) addRecent(recent []WindowCount, at time.Time) []WindowCount {
+	for _, window := range s.windows {
+		seconds := int(window / time.Second)
+		var counter *WindowCount
+		for i := range recent {
+			if recent[i].Seconds == seconds {
+				counter = &recent[i]
+			}
+		}
+		if counter == nil {
+			recent = append(recent, WindowCount{Seconds: seconds, Buckets: make([]uint32, s.windowBuckets)})
+			counter = &recent[len(recent)-1]
+		}
+		counter.add(at)
+	}
+	return recent
+}
+
+// copyWindows returns a deep copy of the window counts
+func copyWindows(recent []WindowCount) []WindowCount {
+	c := make([]WindowCount, len(recent))
+	for i, counter := range recent {
+		counter.Buckets = append([]uint32(nil), counter.Buckets...)
+		c[i] = counter
+	}
+	return c
+}
+
+// keepWindows drops the counts of windows, or bucket counts, that are no
+// longer configured from data loaded from a snapshot
+func (s *URLStore) keepWindows(recent []WindowCount) []WindowCount {
+	kept := recent[:0]
+	for _, counter := range recent {
+		for _, window := range s.windows {
+			if time.Duration(counter.Seconds)*time.Second == window && len(counter.Buckets) == s.windowBuckets {
+				kept = append(kept, counter)
+				break
+			}
+		}
+	}
+	return kept
+}
+
+// Windows returns the windows submissions are counted over
+func (s *URLStore) Windows() []time.Duration {
+	return append([]time.Duration(nil), s.windows...)
+}
+
+// WindowName formats a window the way it is given to the API, such as 5m,
+// 1h or 24h
+func WindowName(window time.Duration) string {
+	name := window.String()
+	if strings.HasSuffix(name, "m0s") {
+		name = name[:len(name)-2]
+	}
+	if strings.HasSuffix(name, "h0m") {
+		name = name[:len(name)-2]
+	}
+	return name
+}